@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/deislabs/gnarly/pkg/gnarly"
+)
+
+// printBake resolves the targets in the bake files with `docker buildx bake --print`, so variables, functions and inheritance are handled exactly as they are for a build.
+// All the default targets are resolved if no targets are passed in.
+func printBake(ctx context.Context, files, targets []string) (gnarly.BakeFile, error) {
+	args := []string{"buildx", "bake", "--print"}
+	for _, f := range files {
+		args = append(args, "--file", f)
+	}
+	args = append(args, targets...)
+
+	out, err := dockerOutput(ctx, args...)
+	if err != nil {
+		return gnarly.BakeFile{}, fmt.Errorf("error resolving bake targets: %w", err)
+	}
+	return gnarly.ParseBakeFile(out)
+}
+
+// generateBake generates replacements for every target in the bake file and returns a bake file which overrides the contexts of the targets with them.
+// Targets without any replacements are left out.
+func generateBake(ctx context.Context, file gnarly.BakeFile) (gnarly.BakeFile, error) {
+	names := make([]string, 0, len(file.Target))
+	for name := range file.Target {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	override := gnarly.BakeFile{Target: make(map[string]gnarly.BakeTarget)}
+	for _, name := range names {
+		t := file.Target[name]
+		dt, err := readDockerfile(ctx, t.DockerfileInline, t.Context, t.Dockerfile)
+		if err != nil {
+			return gnarly.BakeFile{}, fmt.Errorf("error reading dockerfile for bake target %s: %w", name, err)
+		}
+
+		target, err := buildTarget(dt, t.Target, t.Args)
+		if err != nil {
+			return gnarly.BakeFile{}, fmt.Errorf("bake target %s: %w", name, err)
+		}
+
+		opts := newOptions(t.Args, target, t.Contexts)
+		if p := singlePlatform(t.Platforms); p != "" {
+			opts.Platform = p
+		}
+		debug("generating mods for bake target", name)
+		result, err := gnarly.Generate(ctx, dt, opts)
+		if err != nil {
+			return gnarly.BakeFile{}, fmt.Errorf("bake target %s: %w", name, err)
+		}
+		if contexts := gnarly.BakeContexts(result.Sources); contexts != nil {
+			override.Target[name] = gnarly.BakeTarget{Contexts: contexts}
+		}
+	}
+	return override, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/deislabs/gnarly/pkg/gnarly"
+)
+
+func TestBake(t *testing.T) {
+	oldConfig, oldModProg := modConfig, modProg
+	t.Cleanup(func() {
+		modConfig, modProg = oldConfig, oldModProg
+	})
+	modProg = ""
+
+	dir := t.TempDir()
+	modConfig = filepath.Join(dir, "lookup.json")
+	if err := os.WriteFile(modConfig, []byte(`{"golang:1.18": "mcr.microsoft.com/oss/go/microsoft/golang:1.18", "alpine:3.16": "mcr.microsoft.com/mirror/docker/library/alpine:3.16"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	appDir := filepath.Join(dir, "app")
+	if err := os.Mkdir(appDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(appDir, "build.Dockerfile"), []byte("ARG GO_VERSION=1.17\nFROM golang:${GO_VERSION} AS build\nFROM alpine:3.16 AS final\nCOPY --from=build / /\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	argsPath := fakeDocker(t, `{
+	"group": {"default": {"targets": ["app", "tools", "other"]}},
+	"target": {
+		"app": {"context": "`+appDir+`", "dockerfile": "build.Dockerfile", "args": {"GO_VERSION": "1.18"}, "target": "build", "platforms": ["linux/amd64"]},
+		"tools": {"context": "`+appDir+`", "dockerfile": "build.Dockerfile", "args": {"GO_VERSION": "1.18"}},
+		"other": {"context": ".", "dockerfile-inline": "FROM busybox\n"}
+	}
+}`)
+
+	ctx := context.Background()
+	file, err := printBake(ctx, []string{"docker-bake.hcl", "override.hcl"}, []string{"default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "buildx bake --print --file docker-bake.hcl --file override.hcl default"; strings.TrimSpace(string(args)) != expected {
+		t.Fatalf("expected args %q, got %q", expected, args)
+	}
+
+	override, err := generateBake(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := gnarly.BakeFile{Target: map[string]gnarly.BakeTarget{
+		"app": {Contexts: map[string]string{
+			"docker.io/library/golang:1.18": "docker-image://mcr.microsoft.com/oss/go/microsoft/golang:1.18",
+		}},
+		"tools": {Contexts: map[string]string{
+			"docker.io/library/golang:1.18": "docker-image://mcr.microsoft.com/oss/go/microsoft/golang:1.18",
+			"docker.io/library/alpine:3.16": "docker-image://mcr.microsoft.com/mirror/docker/library/alpine:3.16",
+		}},
+	}}
+	if !reflect.DeepEqual(override, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, override)
+	}
+}
+
+func TestBakeTargetContext(t *testing.T) {
+	oldConfig, oldModProg := modConfig, modProg
+	t.Cleanup(func() {
+		modConfig, modProg = oldConfig, oldModProg
+	})
+	modProg = ""
+
+	dir := t.TempDir()
+	modConfig = filepath.Join(dir, "rules.yaml")
+	// Only local contexts under /src are allowed, a target context is not a local context so it must not be denied
+	if err := os.WriteFile(modConfig, []byte(`
+- match: ^docker.io/library/golang:(.*)$
+  replace: mcr.microsoft.com/oss/go/microsoft/golang:$1
+- action: allow
+  type: local
+  match: ^/src/
+- action: allow
+  match: ^mcr.microsoft.com/
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeDocker(t, `{
+	"target": {
+		"base": {"context": ".", "dockerfile-inline": "FROM golang:1.18\n"},
+		"app": {"context": ".", "dockerfile-inline": "FROM base\nCOPY --from=base / /\n", "contexts": {"base": "target:base"}}
+	}
+}`)
+
+	ctx := context.Background()
+	file, err := printBake(ctx, nil, []string{"app", "base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	override, err := generateBake(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := gnarly.BakeFile{Target: map[string]gnarly.BakeTarget{
+		"base": {Contexts: map[string]string{
+			"docker.io/library/golang:1.18": "docker-image://mcr.microsoft.com/oss/go/microsoft/golang:1.18",
+		}},
+	}}
+	if !reflect.DeepEqual(override, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, override)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/deislabs/gnarly/pkg/gnarly"
+)
+
+// composeConfig resolves the compose files with `docker compose config`, so interpolation, extends and the short forms of fields are handled exactly as they are for a build.
+// All services are resolved if no services are passed in.
+func composeConfig(ctx context.Context, files, services []string) (gnarly.ComposeFile, error) {
+	args := []string{"compose"}
+	for _, f := range files {
+		args = append(args, "--file", f)
+	}
+	args = append(args, "config")
+	args = append(args, services...)
+
+	out, err := dockerOutput(ctx, args...)
+	if err != nil {
+		return gnarly.ComposeFile{}, fmt.Errorf("error resolving compose services: %w", err)
+	}
+	return gnarly.ParseComposeFile(out)
+}
+
+// generateCompose generates replacements for every service in the compose file and returns a compose file which overrides the services with them.
+// Services which are built get `additional_contexts` for the replacements, services which only use an image get the replaced image.
+// Services without any replacements are left out.
+func generateCompose(ctx context.Context, file gnarly.ComposeFile) (gnarly.ComposeFile, error) {
+	names := make([]string, 0, len(file.Services))
+	for name := range file.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	override := gnarly.ComposeFile{Services: make(map[string]gnarly.ComposeService)}
+	for _, name := range names {
+		svc := file.Services[name]
+		if svc.Build == nil {
+			if svc.Image == "" {
+				continue
+			}
+			image, err := composeImage(ctx, svc)
+			if err != nil {
+				return gnarly.ComposeFile{}, fmt.Errorf("compose service %s: %w", name, err)
+			}
+			if image != "" {
+				override.Services[name] = gnarly.ComposeService{Image: image}
+			}
+			continue
+		}
+
+		b := svc.Build
+		dt, err := readDockerfile(ctx, b.DockerfileInline, b.Context, b.Dockerfile)
+		if err != nil {
+			return gnarly.ComposeFile{}, fmt.Errorf("error reading dockerfile for compose service %s: %w", name, err)
+		}
+
+		target, err := buildTarget(dt, b.Target, b.Args)
+		if err != nil {
+			return gnarly.ComposeFile{}, fmt.Errorf("compose service %s: %w", name, err)
+		}
+
+		opts := newOptions(b.Args, target, b.AdditionalContexts)
+		switch {
+		case len(b.Platforms) == 1:
+			opts.Platform = b.Platforms[0]
+		case len(b.Platforms) == 0 && svc.Platform != "":
+			opts.Platform = svc.Platform
+		}
+		debug("generating mods for compose service", name)
+		result, err := gnarly.Generate(ctx, dt, opts)
+		if err != nil {
+			return gnarly.ComposeFile{}, fmt.Errorf("compose service %s: %w", name, err)
+		}
+		if contexts := gnarly.BakeContexts(result.Sources); contexts != nil {
+			override.Services[name] = gnarly.ComposeService{Build: &gnarly.ComposeBuild{AdditionalContexts: contexts}}
+		}
+	}
+	return override, nil
+}
+
+// composeImage gets the replacement for the image of a service which is not built, this is empty if there is no replacement.
+// The image is resolved the same way as the base image of a Dockerfile, so the same rules, mod-prog and pinning apply to it.
+func composeImage(ctx context.Context, svc gnarly.ComposeService) (string, error) {
+	opts := newOptions(nil, "", nil)
+	if svc.Platform != "" {
+		opts.Platform = svc.Platform
+	}
+	result, err := gnarly.Generate(ctx, []byte("FROM "+svc.Image+"\n"), opts)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range result.Sources {
+		if image, ok := gnarly.ComposeImage(s); ok {
+			return image, nil
+		}
+		if s.Replace != "" {
+			debug("ignoring replacement for", svc.Image, "which is not an image:", s.Replace)
+		}
+	}
+	return "", nil
+}
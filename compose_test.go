@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompose(t *testing.T) {
+	oldConfig, oldModProg := modConfig, modProg
+	t.Cleanup(func() {
+		modConfig, modProg = oldConfig, oldModProg
+	})
+	modProg = ""
+
+	dir := t.TempDir()
+	modConfig = filepath.Join(dir, "rules.yaml")
+	if err := os.WriteFile(modConfig, []byte("- match: ^docker.io/library/(golang|postgres):(.*)$\n  replace: mirror.example.com/$1:$2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	appDir := filepath.Join(dir, "app")
+	if err := os.Mkdir(appDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(appDir, "Dockerfile"), []byte("ARG GO_VERSION=1.17\nFROM golang:${GO_VERSION} AS build\nFROM alpine:3.16\nCOPY --from=build / /\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	argsPath := fakeDocker(t, `name: app
+services:
+  app:
+    build:
+      context: `+appDir+`
+      dockerfile: Dockerfile
+      args:
+        GO_VERSION: "1.18"
+    image: example.com/app
+  db:
+    image: postgres:14
+  cache:
+    image: redis:7
+  worker:
+    build:
+      context: `+appDir+`
+      dockerfile_inline: |
+        FROM busybox
+`)
+
+	ctx := context.Background()
+	file, err := composeConfig(ctx, []string{"compose.yaml", "compose.dev.yaml"}, []string{"app", "db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "compose --file compose.yaml --file compose.dev.yaml config app db"; strings.TrimSpace(string(args)) != expected {
+		t.Fatalf("expected args %q, got %q", expected, args)
+	}
+
+	override, err := generateCompose(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := override.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `services:
+  app:
+    build:
+      additional_contexts:
+        docker.io/library/golang:1.18: docker-image://mirror.example.com/golang:1.18
+  db:
+    image: mirror.example.com/postgres:14
+`
+	if string(data) != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, data)
+	}
+}
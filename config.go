@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deislabs/gnarly/pkg/gnarly"
+)
+
+// modConfigPaths gets the list of mod configs, from lowest to highest precedence.
+// Multiple configs are separated by the OS path list separator (`:` on unix).
+func modConfigPaths() []string {
+	return filepath.SplitList(modConfig)
+}
+
+// addDiscoveredConfig adds a repo-local mod config from the passed in dirs to the mod configs, with the highest precedence.
+// Nothing is discovered when a mod-prog is set, since the mod configs are passed to it and a repo should not be able to change how an external program behaves.
+func addDiscoveredConfig(dirs ...string) {
+	if noDiscoverConfig {
+		return
+	}
+	if modProg != "" {
+		debug("not discovering mod config since a mod-prog is set")
+		return
+	}
+
+	p := gnarly.DiscoverConfig(dirs...)
+	if p == "" {
+		return
+	}
+	for _, existing := range modConfigPaths() {
+		if sameFile(existing, p) {
+			return
+		}
+	}
+
+	debug("using discovered mod config", p)
+	if modConfig == "" {
+		modConfig = p
+		return
+	}
+	modConfig = strings.Join(append(modConfigPaths(), p), string(os.PathListSeparator))
+}
+
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
+
+// contextConfigDirs gets the dirs to look for a repo-local mod config in for a build context, the dir the Dockerfile is in and then the root of the context.
+// Only local contexts are searched.
+func contextConfigDirs(buildCtx, dockerfile string) []string {
+	if buildCtx == "" || buildCtx == "-" {
+		return nil
+	}
+	if typ, _ := gnarly.ContextSource(buildCtx); typ != gnarly.SourceTypeLocal {
+		return nil
+	}
+	if fi, err := os.Stat(buildCtx); err != nil || !fi.IsDir() {
+		return nil
+	}
+
+	p := dockerfile
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(buildCtx, p)
+	}
+	return []string{filepath.Dir(p), buildCtx}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddDiscoveredConfig(t *testing.T) {
+	oldConfig, oldNoDiscover, oldModProg := modConfig, noDiscoverConfig, modProg
+	t.Cleanup(func() {
+		modConfig, noDiscoverConfig, modProg = oldConfig, oldNoDiscover, oldModProg
+	})
+	noDiscoverConfig = false
+	modProg = ""
+
+	ctxDir := t.TempDir()
+	subDir := filepath.Join(ctxDir, "build")
+	if err := os.Mkdir(subDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{filepath.Join(ctxDir, ".gnarly.yaml"), filepath.Join(subDir, ".gnarly.toml"), filepath.Join(subDir, ".gnarly.json")} {
+		if err := os.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs := contextConfigDirs(ctxDir, "build/Dockerfile")
+	if expected := []string{subDir, ctxDir}; !reflect.DeepEqual(dirs, expected) {
+		t.Fatalf("expected dirs %v, got %v", expected, dirs)
+	}
+	for _, buildCtx := range []string{"-", "https://github.com/deislabs/gnarly.git", "https://example.com/context.tar.gz", filepath.Join(ctxDir, "missing")} {
+		if dirs := contextConfigDirs(buildCtx, "Dockerfile"); dirs != nil {
+			t.Errorf("%s: expected no dirs, got %v", buildCtx, dirs)
+		}
+	}
+
+	modConfig = "/etc/gnarly/org.json"
+	addDiscoveredConfig(dirs...)
+	expected := "/etc/gnarly/org.json" + string(os.PathListSeparator) + filepath.Join(subDir, ".gnarly.json")
+	if modConfig != expected {
+		t.Errorf("expected %s, got %s", expected, modConfig)
+	}
+	// Configs which are already passed in are not added again
+	addDiscoveredConfig(dirs...)
+	if modConfig != expected {
+		t.Errorf("expected %s, got %s", expected, modConfig)
+	}
+
+	modProg = "mod-prog"
+	modConfig = ""
+	addDiscoveredConfig(dirs...)
+	if modConfig != "" {
+		t.Errorf("expected no config to be discovered with a mod-prog, got %s", modConfig)
+	}
+
+	modProg = ""
+	noDiscoverConfig = true
+	addDiscoveredConfig(dirs...)
+	if modConfig != "" {
+		t.Errorf("expected no config when discovery is disabled, got %s", modConfig)
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	v := "default.json"
+	f := &listFlag{v: &v}
+	for _, s := range []string{"org.json", "team.yaml"} {
+		if err := f.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := strings.Join([]string{"org.json", "team.yaml"}, string(os.PathListSeparator)); v != expected {
+		t.Errorf("expected %s, got %s", expected, v)
+	}
+}
@@ -13,21 +13,32 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
+
+	"github.com/deislabs/gnarly/pkg/gnarly"
 )
 
 const (
 	dockerBin = "docker"
 	pathEnv   = "PATH"
+
+	// urlContextTimeout is how long to wait on fetching a url context, including reading the body up to the Dockerfile
+	urlContextTimeout = 5 * time.Minute
 )
 
+// urlContextClient is used to fetch url contexts, so a server which stops responding cannot hang the build forever.
+var urlContextClient = &http.Client{Timeout: urlContextTimeout}
+
 // Env vars which are used when gnarly is invoked as a wrapper for the docker binary.
 var (
 	// Pass through a custom syntax parser to the docker build command.
@@ -112,12 +123,14 @@ func debug(args ...interface{}) {
 
 type dockerArgs struct {
 	BuildArgs      map[string]string
+	BuildContexts  map[string]string
 	DockerfileName string
 	Build          bool
 	BuildPos       int
 	Buildx         bool
 	Context        string
 	MetaData       string
+	Target         string
 	FilterFlags    []int
 	Tags           []string
 	Output         []string
@@ -152,6 +165,7 @@ func newDockerArgs() dockerArgs {
 
 	return dockerArgs{
 		BuildArgs:      make(map[string]string),
+		BuildContexts:  make(map[string]string),
 		DockerfileName: "Dockerfile",
 		Tags:           tags,
 		Output:         output,
@@ -180,8 +194,17 @@ func handleDockerFlag(arg, next string, dArgs *dockerArgs) (handledNext bool, om
 			}
 			debug("setting build arg", split[0], v)
 			dArgs.BuildArgs[split[0]] = v
+		case "--build-context":
+			split := strings.SplitN(value, "=", 2)
+			if len(split) == 2 {
+				debug("setting build context", split[0], split[1])
+				dArgs.BuildContexts[split[0]] = split[1]
+			}
 		case "-f", "--file":
 			dArgs.DockerfileName = value
+		case "--target":
+			debug("setting target", value)
+			dArgs.Target = value
 		case "--metadata-file":
 			debug("setting metadata file", arg, value)
 			dArgs.MetaData = value
@@ -360,7 +383,11 @@ func invokeDocker(ctx context.Context) error {
 			args = append(args, "--build-arg=BUILDKIT_SYNTAX="+parser)
 		}
 
-		var result Result
+		if modPath == "" {
+			addDiscoveredConfig(contextConfigDirs(dArgs.Context, dArgs.DockerfileName)...)
+		}
+
+		var result gnarly.Result
 		switch {
 		case modPath != "":
 			debug("Reading source replacements from", modPath)
@@ -372,19 +399,27 @@ func invokeDocker(ctx context.Context) error {
 			if err := json.Unmarshal(data, &result); err != nil {
 				return fmt.Errorf("error parsing specified modfile: %w", err)
 			}
-		case modConfig != "":
-			debug("Generating source replacements from config", modConfig, "using prog", modProg)
-			dt, err := getDockerfile(dArgs.Context, dArgs.DockerfileName)
+			if dArgs.Target != "" {
+				result.Sources = filterTarget(result.Sources, dArgs.Target)
+			}
+		case modConfig != "" || modTable != "" || modProg != "" || pinMode != "":
+			debug("Generating source replacements from config", modConfig, "table", modTable, "using prog", modProg)
+			dt, err := getDockerfile(ctx, dArgs.Context, dArgs.DockerfileName)
+			if err != nil {
+				return err
+			}
+
+			target, err := buildTarget(dt, dArgs.Target, dArgs.BuildArgs)
 			if err != nil {
 				return err
 			}
 
-			result, err = Generate(ctx, dt, dArgs.BuildArgs)
+			result, err = gnarly.Generate(ctx, dt, newOptions(dArgs.BuildArgs, target, dArgs.BuildContexts))
 			if err != nil {
 				return err
 			}
 		default:
-			debug("no modfile or modconfig, skipping source analysis")
+			debug("no modfile, modconfig, modtable, modprog or pin mode, skipping source analysis")
 		}
 
 		for _, o := range dArgs.Output {
@@ -417,9 +452,10 @@ func invokeDocker(ctx context.Context) error {
 			args = append(args, "-t="+t)
 		}
 
+		// Named contexts which were passed in by the user are overridden by appending them again, buildx uses the last value for a name.
 		for _, s := range result.Sources {
-			if s.Replace != "" {
-				args = append(args, fmt.Sprintf("--build-context=%s=%s://%s", s.Ref, s.Type, s.Replace))
+			if bc, ok := s.BuildContext(); ok {
+				args = append(args, "--build-context="+bc)
 			}
 		}
 	}
@@ -467,6 +503,25 @@ func invokeDocker(ctx context.Context) error {
 	return err
 }
 
+// filterTarget filters out sources from a modfile which are not used by the target.
+// Sources which do not have any targets listed are kept since there is no way to know if they are used.
+func filterTarget(sources []gnarly.Source, target string) []gnarly.Source {
+	var filtered []gnarly.Source
+	for _, s := range sources {
+		if len(s.Targets) == 0 {
+			filtered = append(filtered, s)
+			continue
+		}
+		for _, t := range s.Targets {
+			if strings.EqualFold(t, target) {
+				filtered = append(filtered, s)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
 const (
 	Uncompressed = iota
 	Bzip2
@@ -491,17 +546,14 @@ func detectCompression(magic []byte) int {
 	return Uncompressed
 }
 
-type unsupportedURLContext struct {
-	scheme string
-}
-
-func (e unsupportedURLContext) Error() string {
-	return "unsupported context scheme: " + e.scheme
-}
+func getDockerfile(ctx context.Context, buildCtx, p string) ([]byte, error) {
+	// As with buildx, an absolute Dockerfile path is always read locally, even for a remote context or one read from stdin.
+	if filepath.IsAbs(p) {
+		return os.ReadFile(p)
+	}
 
-func getDockerfile(context, p string) ([]byte, error) {
-	if context == "-" {
-		f, err := os.CreateTemp("", "dockermod-"+context)
+	if buildCtx == "-" {
+		f, err := os.CreateTemp("", "dockermod-"+buildCtx)
 		if err != nil {
 			return nil, fmt.Errorf("error creating temp file to pipe from stdin: %w", err)
 		}
@@ -525,24 +577,99 @@ func getDockerfile(context, p string) ([]byte, error) {
 		return dt, nil
 	}
 
-	u, err := url.Parse(context)
+	if gnarly.IsGitContext(buildCtx) {
+		return dockerfileFromGit(ctx, buildCtx, p)
+	}
+
+	u, err := url.Parse(buildCtx)
 	if err == nil {
 		switch u.Scheme {
 		case "http", "https":
-			return nil, unsupportedURLContext{u.Scheme}
-		case "git":
-			return nil, unsupportedURLContext{u.Scheme}
+			return dockerfileFromURL(ctx, buildCtx, p)
 		}
 	}
 
-	if p[0] == '/' {
-		return os.ReadFile(p)
+	if _, err := os.Stat(buildCtx); err == nil {
+		return os.ReadFile(filepath.Join(buildCtx, p))
+	}
+
+	return nil, fmt.Errorf("unable to locate %s in context %s", p, buildCtx)
+}
+
+// readDockerfile reads the Dockerfile for a build defined in a bake or compose file, the inline Dockerfile is used if there is one.
+// The context defaults to the current dir and the Dockerfile to `Dockerfile` in the context.
+func readDockerfile(ctx context.Context, inline, buildCtx, p string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
 	}
-	if _, err := os.Stat(context); err == nil {
-		return os.ReadFile(filepath.Join(context, p))
+	if buildCtx == "" {
+		buildCtx = "."
+	}
+	if p == "" {
+		p = "Dockerfile"
+	}
+	return getDockerfile(ctx, buildCtx, p)
+}
+
+// buildTarget gets the target to generate replacements for.
+// Only the default target is built when no target is specified, so that is used instead.
+func buildTarget(dt []byte, target string, buildArgs map[string]string) (string, error) {
+	if target != "" {
+		return target, nil
+	}
+	return gnarly.DefaultTarget(dt, buildArgs)
+}
+
+// singlePlatform gets the platform to match rules against for a build with the passed in platforms.
+// Contexts are set for the whole build, so this is only set if there is just one platform.
+func singlePlatform(platforms []string) string {
+	if len(platforms) != 1 {
+		return ""
+	}
+	return platforms[0]
+}
+
+// dockerOutput runs docker with the args and returns what it prints to stdout, what it prints to stderr is included in the error if it fails.
+func dockerOutput(ctx context.Context, args ...string) ([]byte, error) {
+	d := lookPath(dockerBin)
+	if d == "" {
+		return nil, &exec.Error{Name: dockerBin, Err: exec.ErrNotFound}
+	}
+
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.CommandContext(ctx, d, args...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// dockerfileFromURL streams the response body of the url through dockerfileFromReader.
+// As with buildx, the body may either be the raw Dockerfile or a (optionally compressed) tarball containing the context.
+func dockerfileFromURL(ctx context.Context, u, p string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for url context: %w", err)
+	}
+
+	debug("fetching url context", u)
+	resp, err := urlContextClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching url context: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching url context %s: unexpected status: %s", u, resp.Status)
 	}
 
-	return nil, fmt.Errorf("unable to locate %s in context %s", p, context)
+	dt, err := dockerfileFromReader(resp.Body, p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dockerfile from url context %s: %w", u, err)
+	}
+	return dt, nil
 }
 
 func xzStream(in io.Reader) (io.Reader, error) {
@@ -577,7 +704,8 @@ func dockerfileFromReader(f io.Reader, p string) ([]byte, error) {
 		return nil, err
 	}
 
-	switch detectCompression(magic) {
+	compression := detectCompression(magic)
+	switch compression {
 	case Bzip2:
 		rdr = bzip2.NewReader(rdr)
 	case Gzip:
@@ -592,6 +720,16 @@ func dockerfileFromReader(f io.Reader, p string) ([]byte, error) {
 		}
 	}
 
+	if compression != Uncompressed {
+		// The tar header must be checked against the decompressed stream
+		bufReader = bufio.NewReader(rdr)
+		rdr = bufReader
+		magic, err = bufReader.Peek(1024)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
 	tr := tar.NewReader(bytes.NewBuffer(magic))
 	if _, err := tr.Next(); err != nil {
 		// Not an archive
@@ -602,10 +740,13 @@ func dockerfileFromReader(f io.Reader, p string) ([]byte, error) {
 	for {
 		th, err := tr.Next()
 		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("%s not found in context archive", p)
+			}
 			return nil, err
 		}
 
-		if th.Name != p {
+		if path.Clean(th.Name) != path.Clean(p) {
 			continue
 		}
 
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/deislabs/gnarly/pkg/gnarly"
 )
 
 func TestDockerfileFromReader(t *testing.T) {
@@ -25,6 +36,92 @@ RUN echo hello
 	})
 }
 
+func TestDockerfileFromURL(t *testing.T) {
+	dockerfile := "FROM busybox\nRUN echo hello\n"
+
+	tarball := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(tarball)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{
+		"./README.md":       "hello",
+		"./sub/Dockerfile2": dockerfile,
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Dockerfile", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(dockerfile))
+	})
+	mux.HandleFunc("/context.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball.Bytes())
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	t.Run("raw dockerfile", func(t *testing.T) {
+		dt, err := getDockerfile(ctx, srv.URL+"/Dockerfile", "Dockerfile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dt) != dockerfile {
+			t.Fatalf("Expected %s, got %s", dockerfile, string(dt))
+		}
+	})
+
+	t.Run("tarball", func(t *testing.T) {
+		dt, err := getDockerfile(ctx, srv.URL+"/context.tar.gz", "sub/Dockerfile2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dt) != dockerfile {
+			t.Fatalf("Expected %s, got %s", dockerfile, string(dt))
+		}
+
+		if _, err := getDockerfile(ctx, srv.URL+"/context.tar.gz", "Dockerfile"); err == nil {
+			t.Fatal("expected error for dockerfile missing from tarball")
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := getDockerfile(ctx, srv.URL+"/missing", "Dockerfile"); err == nil {
+			t.Fatal("expected error for missing url")
+		}
+	})
+}
+
+func TestGetDockerfileAbsolutePath(t *testing.T) {
+	dockerfile := "FROM busybox\n"
+	p := filepath.Join(t.TempDir(), "Dockerfile")
+	if err := os.WriteFile(p, []byte(dockerfile), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote contexts are never fetched, so they do not need to exist
+	for _, buildCtx := range []string{"https://github.com/deislabs/gnarly.git#main", "https://example.invalid/context.tar.gz", "."} {
+		dt, err := getDockerfile(context.Background(), buildCtx, p)
+		if err != nil {
+			t.Fatalf("%s: %v", buildCtx, err)
+		}
+		if string(dt) != dockerfile {
+			t.Fatalf("%s: expected %s, got %s", buildCtx, dockerfile, dt)
+		}
+	}
+}
+
 func TestParseDockerArgs(t *testing.T) {
 	dArgs := newDockerArgs()
 	parseDockerArgs([]string{"run", "-it", "--rm", "busybox", "sh"}, &dArgs)
@@ -69,6 +166,27 @@ func TestParseDockerArgs(t *testing.T) {
 		t.Errorf("Got unexpected context path, expected -, got: %s", dArgs.Context)
 	}
 
+	dArgs = newDockerArgs()
+	parseDockerArgs([]string{"build", "--target", "foo", "."}, &dArgs)
+	if dArgs.Target != "foo" {
+		t.Errorf("Got unexpected target, expected foo, got: %s", dArgs.Target)
+	}
+	if dArgs.Context != "." {
+		t.Errorf("Got unexpected context path, expected ., got: %s", dArgs.Context)
+	}
+
+	dArgs = newDockerArgs()
+	parseDockerArgs([]string{"build", "--build-context", "deps=../deps", "--build-context=alpine=docker-image://alpine:3.16", "."}, &dArgs)
+	if v := dArgs.BuildContexts["deps"]; v != "../deps" {
+		t.Errorf("Got unexpected build context, expected ../deps, got: %s", v)
+	}
+	if v := dArgs.BuildContexts["alpine"]; v != "docker-image://alpine:3.16" {
+		t.Errorf("Got unexpected build context, expected docker-image://alpine:3.16, got: %s", v)
+	}
+	if dArgs.Context != "." {
+		t.Errorf("Got unexpected context path, expected ., got: %s", dArgs.Context)
+	}
+
 	osArgs := []string{"build", "--build-arg", "foo=bar", "--bool-flag", "-t", "foo", "--output=type=registry,dest=bar", "--other-flag", "some value", "--build-arg=baz=quux", "--file", t.Name(), "."}
 	dArgs = newDockerArgs()
 	parseDockerArgs(osArgs, &dArgs)
@@ -126,3 +244,58 @@ func TestParseDockerArgs(t *testing.T) {
 		t.Error("Expected `build` to be false since it is a not a docker build command")
 	}
 }
+
+func TestFilterTarget(t *testing.T) {
+	sources := []gnarly.Source{
+		{Type: "docker-image", Ref: "docker.io/library/alpine:latest", Targets: []string{"stage-2"}},
+		{Type: "docker-image", Ref: "docker.io/library/busybox:latest", Targets: []string{"base", "stage-2"}},
+		{Type: "docker-image", Ref: "docker.io/library/golang:1.18"},
+	}
+
+	filtered := filterTarget(sources, "Base")
+	expected := []gnarly.Source{sources[1], sources[2]}
+	if !reflect.DeepEqual(filtered, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, filtered)
+	}
+}
+
+func TestNewOptionsPlatform(t *testing.T) {
+	oldPlatform := buildkitPlatform
+	t.Cleanup(func() {
+		buildkitPlatform = oldPlatform
+	})
+
+	for platform, expected := range map[string]string{
+		"":                        "",
+		"linux/arm64":             "linux/arm64",
+		"linux/amd64,linux/arm64": "",
+	} {
+		buildkitPlatform = platform
+		if opts := newOptions(nil, "", nil); opts.Platform != expected {
+			t.Errorf("%q: expected platform %q, got %q", platform, expected, opts.Platform)
+		}
+	}
+}
+
+func TestNewOptionsModCacheTTL(t *testing.T) {
+	oldTTL, oldNoCache := modCacheTTL, noModCache
+	t.Cleanup(func() {
+		modCacheTTL, noModCache = oldTTL, oldNoCache
+	})
+	noModCache = false
+
+	for _, tc := range []struct {
+		ttl     time.Duration
+		noCache bool
+	}{
+		{time.Hour, false},
+		{-1, false},
+		{0, true},
+	} {
+		modCacheTTL = tc.ttl
+		opts := newOptions(nil, "", nil)
+		if opts.NoModCache != tc.noCache || opts.ModCacheTTL != tc.ttl {
+			t.Errorf("%s: expected no cache %v with ttl %s, got %v with %s", tc.ttl, tc.noCache, tc.ttl, opts.NoModCache, opts.ModCacheTTL)
+		}
+	}
+}
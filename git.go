@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// gitRef is a parsed git build context in the form of `<remote>#<ref>:<subdir>`
+type gitRef struct {
+	Remote string
+	Ref    string
+	Subdir string
+}
+
+func parseGitRef(buildCtx string) gitRef {
+	var g gitRef
+
+	split := strings.SplitN(buildCtx, "#", 2)
+	g.Remote = split[0]
+	if strings.HasPrefix(g.Remote, "github.com/") {
+		g.Remote = "https://" + g.Remote
+	}
+
+	if len(split) == 2 {
+		refAndDir := strings.SplitN(split[1], ":", 2)
+		g.Ref = refAndDir[0]
+		if len(refAndDir) == 2 {
+			g.Subdir = refAndDir[1]
+		}
+	}
+	return g
+}
+
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %s: %w", strings.Join(args, " "), strings.TrimSpace(stderr.String()), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// dockerfileFromGit does a shallow fetch of the referenced git repo and reads the dockerfile at path `p` (relative to the subdir in the context) out of it.
+// Nothing is checked out, the file is read directly from the fetched commit.
+func dockerfileFromGit(ctx context.Context, buildCtx, p string) ([]byte, error) {
+	g := parseGitRef(buildCtx)
+
+	dir, err := os.MkdirTemp("", "gnarly-git-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp dir for git context: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := git(ctx, dir, "init", "-q", "--bare"); err != nil {
+		return nil, err
+	}
+
+	ref := g.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	debug("fetching git context", g.Remote, "ref:", ref)
+	if _, err := git(ctx, dir, "fetch", "-q", "--depth=1", "--no-tags", g.Remote, ref); err != nil {
+		return nil, fmt.Errorf("error fetching git context: %w", err)
+	}
+
+	fp := strings.TrimPrefix(path.Join(g.Subdir, p), "/")
+	dt, err := git(ctx, dir, "show", "FETCH_HEAD:"+fp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate %s in git context %s: %w", fp, buildCtx, err)
+	}
+	return dt, nil
+}
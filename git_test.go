@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseGitRef(t *testing.T) {
+	g := parseGitRef("github.com/deislabs/gnarly#main:some/dir")
+	if g.Remote != "https://github.com/deislabs/gnarly" {
+		t.Errorf("unexpected remote: %s", g.Remote)
+	}
+	if g.Ref != "main" {
+		t.Errorf("unexpected ref: %s", g.Ref)
+	}
+	if g.Subdir != "some/dir" {
+		t.Errorf("unexpected subdir: %s", g.Subdir)
+	}
+
+	g = parseGitRef("git://example.com/repo.git")
+	if g.Remote != "git://example.com/repo.git" || g.Ref != "" || g.Subdir != "" {
+		t.Errorf("unexpected git ref: %+v", g)
+	}
+}
+
+func TestDockerfileFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	ctx := context.Background()
+
+	work := t.TempDir()
+	bare := filepath.Join(t.TempDir(), "repo.git")
+
+	run := func(dir string, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+
+	rootDockerfile := "FROM busybox\n"
+	subDockerfile := "FROM alpine\n"
+
+	run(work, "init", "-q", "-b", "main")
+	if err := os.WriteFile(filepath.Join(work, "Dockerfile"), []byte(rootDockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(work, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, "sub", "Dockerfile.test"), []byte(subDockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(work, "add", "-A")
+	run(work, "commit", "-q", "-m", "initial")
+	run(work, "tag", "v1")
+	run(filepath.Dir(bare), "clone", "-q", "--bare", work, bare)
+
+	remote := "file://" + bare
+
+	dt, err := getDockerfile(ctx, remote, "Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != rootDockerfile {
+		t.Errorf("expected %q, got %q", rootDockerfile, string(dt))
+	}
+
+	dt, err = getDockerfile(ctx, remote+"#v1:sub", "Dockerfile.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != subDockerfile {
+		t.Errorf("expected %q, got %q", subDockerfile, string(dt))
+	}
+
+	if _, err := getDockerfile(ctx, remote+"#main", "Dockerfile.missing"); err == nil {
+		t.Error("expected error for missing dockerfile")
+	}
+}
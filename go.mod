@@ -3,16 +3,21 @@ module github.com/deislabs/gnarly
 go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.0
+	github.com/Masterminds/semver/v3 v3.1.1
+	github.com/containerd/containerd v1.6.3
+	github.com/docker/distribution v2.8.1+incompatible
 	github.com/moby/buildkit v0.10.1-0.20220402051847-3e38a2d34830
 	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.0.3-0.20211202183452-c5a74bcca799
+	github.com/sirupsen/logrus v1.8.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/agext/levenshtein v1.2.3 // indirect
-	github.com/containerd/containerd v1.6.3 // indirect
 	github.com/containerd/ttrpc v1.1.0 // indirect
 	github.com/containerd/typeurl v1.0.2 // indirect
-	github.com/docker/distribution v2.8.1+incompatible // indirect
 	github.com/docker/docker v20.10.14+incompatible // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-units v0.4.0 // indirect
@@ -23,9 +28,7 @@ require (
 	github.com/klauspost/compress v1.15.1 // indirect
 	github.com/moby/locker v1.0.1 // indirect
 	github.com/moby/sys/signal v0.6.0 // indirect
-	github.com/opencontainers/image-spec v1.0.3-0.20211202183452-c5a74bcca799 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
 	github.com/tonistiigi/fsutil v0.0.0-20220413024721-3c5c7e848994 // indirect
 	golang.org/x/crypto v0.0.0-20220315160706-3147a52a75dd // indirect
 	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd // indirect
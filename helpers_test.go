@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeDocker puts a docker on the PATH which prints the output and records the args it was called with to the returned path.
+func fakeDocker(t *testing.T, output string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsPath + "\ncat <<'EOF'\n" + output + "\nEOF\n"
+	if err := os.WriteFile(filepath.Join(dir, dockerBin), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(pathEnv, dir+string(os.PathListSeparator)+os.Getenv(pathEnv))
+	return argsPath
+}
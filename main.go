@@ -8,18 +8,50 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
+
+	"github.com/deislabs/gnarly/pkg/gnarly"
 )
 
 const (
-	formatModfile    = "modfile"
-	formatBuildFlags = "build-flags"
+	formatModfile     = "modfile"
+	formatBuildFlags  = "build-flags"
+	formatExplain     = "explain"
+	formatExplainJSON = "explain-json"
+	formatBake        = "bake"
 )
 
 var (
 	modProg   = os.Getenv("DOCKERFILE_MOD_PROG")
 	modConfig = os.Getenv("DOCKERFILE_MOD_CONFIG")
+	modTable  = os.Getenv("DOCKERFILE_MOD_TABLE")
+	pinMode   = os.Getenv("DOCKERFILE_MOD_PIN")
+
+	modProtocol = os.Getenv("DOCKERFILE_MOD_PROTOCOL")
+	modTimeout  = envDuration("DOCKERFILE_MOD_TIMEOUT", gnarly.DefaultModTimeout)
+	modOnError  = os.Getenv("DOCKERFILE_MOD_ON_ERROR")
+	modJobs     = envInt("DOCKERFILE_MOD_JOBS", runtime.NumCPU())
+
+	noDiscoverConfig, _ = strconv.ParseBool(os.Getenv("DOCKERFILE_MOD_NO_DISCOVER_CONFIG"))
+
+	modMaxRulePasses = envInt("DOCKERFILE_MOD_MAX_RULE_PASSES", gnarly.DefaultMaxRulePasses)
+
+	policyMode = os.Getenv("DOCKERFILE_MOD_POLICY")
+
+	modCacheTTL   = envDuration("DOCKERFILE_MOD_CACHE_TTL", gnarly.DefaultModCacheTTL)
+	noModCache, _ = strconv.ParseBool(os.Getenv("DOCKERFILE_MOD_NO_CACHE"))
+
+	resolveConfig, _ = strconv.ParseBool(os.Getenv("DOCKERFILE_MOD_RESOLVE_CONFIG"))
+
+	bakeFile   = os.Getenv("DOCKERFILE_MOD_BAKE_FILE")
+	bakeTarget = "default"
+
+	composeFile = os.Getenv("DOCKERFILE_MOD_COMPOSE_FILE")
 )
 
 func main() {
@@ -29,18 +61,50 @@ func main() {
 	}
 
 	buildArgs := argFlag{}
+	buildContexts := argFlag{}
+	var target string
 	format := os.Getenv("DOCKERFILE_MOD_FORMAT")
 	if format == "" {
 		format = formatBuildFlags
 	}
 
 	flag.Var(&buildArgs, "build-arg", "set build args to pass through -- these are required if the dockerfie uses args to determine an image source")
+	flag.Var(&buildContexts, "build-context", "set named build contexts to pass through -- sources provided by a named context are reported with the context instead of the image it replaces")
+	flag.StringVar(&target, "target", "", "Set the target build stage to analyze, by default all targets are analyzed")
 	flag.StringVar(&modProg, "mod-prog", modProg, "Set program to execute to modify a reference as a replace rule")
-	flag.StringVar(&modConfig, "mod-config", modConfig, "Set the config file to pass to mod prog")
-	flag.StringVar(&format, "format", format, "Set the output format. Formats: modfile, build-flags")
+	flag.Var(&listFlag{v: &modConfig}, "mod-config", "Set the config file to pass to mod prog, can be passed multiple times with later configs taking precedence")
+	flag.Var(&listFlag{v: &modTable}, "mod-table", "Set a JSON lookup table of refs to their replacements, checked before the mod prog or builtin matchers. Can be passed multiple times with later tables taking precedence")
+	flag.BoolVar(&noDiscoverConfig, "no-discover-config", noDiscoverConfig, "Do not look for a repo-local mod config (e.g. .gnarly.json) next to the Dockerfile, configs are never discovered when a mod-prog is set")
+	flag.StringVar(&modProtocol, "mod-protocol", modProtocol, "Set the protocol used to talk to the mod prog. Protocols: args (run once per ref with the ref as an argument), json (run once with a JSON request for all sources on stdin), plugin (run once and send a JSON request per line for each source)")
+	flag.StringVar(&modOnError, "mod-on-error", modOnError, "Set what to do when the mod prog fails. Policies: fail (default), skip (leave the source without a replacement), builtin (use the builtin matchers from the mod config)")
+	flag.IntVar(&modMaxRulePasses, "max-rule-passes", modMaxRulePasses, "Set the limit on passes over the builtin matcher rules for a single ref when rules are chained")
+	flag.StringVar(&policyMode, "policy", policyMode, "Set how allow and deny rules in the mod config are applied to sources without a replacement. Modes: enforce (default, fail with a report), warn (only print the report), off. Setting a mode also reads policy rules from the mod config when using a mod prog")
+	flag.BoolVar(&noModCache, "no-mod-cache", noModCache, "Do not use cached replacements from previous runs of the mod prog, or cache new ones")
+	flag.DurationVar(&modCacheTTL, "mod-cache-ttl", modCacheTTL, "Set how long replacements from the mod prog are cached for, 0 disables the cache and a negative value means cached replacements never expire")
+	flag.IntVar(&modJobs, "jobs", modJobs, "Set the number of sources to resolve replacements (and pins) for in parallel")
+	flag.DurationVar(&modTimeout, "mod-timeout", modTimeout, "Set how long to wait for a mod prog plugin to respond to a request or to exit")
+	flag.StringVar(&format, "format", format, "Set the output format. Formats: modfile, build-flags, explain (how each source was or was not replaced), explain-json, bake (a bake file overriding the contexts of a target)")
+	flag.StringVar(&bakeTarget, "bake-target", bakeTarget, "Set the bake target to override the contexts of with the bake format")
+	flag.Var(&listFlag{v: &bakeFile}, "bake-file", "Read a docker buildx bake file and output a bake file overriding the contexts of every target instead of reading a Dockerfile. Any args are the bake targets to generate for. Can be passed multiple times")
+	flag.Var(&listFlag{v: &composeFile}, "compose-file", "Read a docker compose file and output a compose override file with the replacements for every service instead of reading a Dockerfile. Any args are the services to generate for. Can be passed multiple times")
+	flag.BoolVar(&resolveConfig, "resolve-config", resolveConfig, "Fetch real image configs from the registry to analyze stages which depend on them (e.g. ONBUILD triggers). Falls back to cached or empty configs when the registry cannot be reached")
+	flag.StringVar(&pinMode, "pin", pinMode, "Resolve sources to pinned digests using the registry. Modes: replace (only replacements), all (replacements and any ref without a replacement)")
 
 	flag.Parse()
 
+	if bakeFile != "" && composeFile != "" {
+		fmt.Fprintln(os.Stderr, "a bake file and a compose file cannot be used together")
+		os.Exit(1)
+	}
+	if bakeFile != "" {
+		runBake(flag.Args(), format)
+		return
+	}
+	if composeFile != "" {
+		runCompose(flag.Args(), format)
+		return
+	}
+
 	var (
 		err error
 		dt  []byte
@@ -63,10 +127,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The Dockerfile is usually in the context, which is usually the current dir
+	configDirs := []string{"."}
+	if flag.NArg() > 0 && flag.Arg(0) != "-" {
+		configDirs = append([]string{filepath.Dir(flag.Arg(0))}, configDirs...)
+	}
+	addDiscoveredConfig(configDirs...)
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	result, err := Generate(ctx, dt, buildArgs)
+	result, err := gnarly.Generate(ctx, dt, newOptions(buildArgs, target, buildContexts))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error generating mods:", err)
 		os.Exit(2)
@@ -80,6 +151,30 @@ func main() {
 		}
 		fmt.Println(string(data))
 		return
+	case formatExplain:
+		if err := gnarly.WriteExplanations(os.Stdout, result.Explanations); err != nil {
+			fmt.Fprintln(os.Stderr, "error writing explanations:", err)
+			os.Exit(1)
+		}
+		return
+	case formatExplainJSON:
+		data, err := json.MarshalIndent(result.Explanations, "", "\t")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(data))
+		return
+	case formatBake:
+		override := gnarly.BakeFile{Target: map[string]gnarly.BakeTarget{}}
+		if contexts := gnarly.BakeContexts(result.Sources); contexts != nil {
+			override.Target[bakeTarget] = gnarly.BakeTarget{Contexts: contexts}
+		}
+		data, err := json.MarshalIndent(override, "", "\t")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(data))
+		return
 	case formatBuildFlags:
 		sb := &strings.Builder{}
 
@@ -87,9 +182,15 @@ func main() {
 			sb.WriteString(fmt.Sprintf("--build-arg %s=%s ", k, v))
 		}
 
+		for k, v := range buildContexts {
+			if _, ok := gnarly.ReplacedContext(result.Sources, k); !ok {
+				sb.WriteString(fmt.Sprintf("--build-context %s=%s ", k, v))
+			}
+		}
+
 		for _, resolved := range result.Sources {
-			if resolved.Replace != "" {
-				sb.WriteString(fmt.Sprintf("--build-context %s=docker-image://%s ", resolved.Ref, resolved.Replace))
+			if bc, ok := resolved.BuildContext(); ok {
+				sb.WriteString(fmt.Sprintf("--build-context %s ", bc))
 			}
 		}
 		fmt.Print(sb.String())
@@ -100,6 +201,158 @@ func main() {
 	}
 }
 
+// runBake generates a bake file overriding the contexts of the targets in the bake files, instead of generating mods for a single Dockerfile.
+func runBake(targets []string, format string) {
+	// The format defaults to build-flags for a Dockerfile, but only a bake file can be output for a bake file
+	if format != formatBake && format != formatBuildFlags {
+		fmt.Fprintln(os.Stderr, "unsupported format for a bake file:", format)
+		os.Exit(1)
+	}
+
+	addDiscoveredConfig(".")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	file, err := printBake(ctx, filepath.SplitList(bakeFile), targets)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	override, err := generateBake(ctx, file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error generating mods:", err)
+		os.Exit(2)
+	}
+
+	data, err := json.MarshalIndent(override, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(data))
+}
+
+// runCompose generates a compose override file for the services in the compose files, instead of generating mods for a single Dockerfile.
+func runCompose(services []string, format string) {
+	// Only a compose file can be output for a compose file, so the format can only be left as the default
+	if format != formatBuildFlags {
+		fmt.Fprintln(os.Stderr, "unsupported format for a compose file:", format)
+		os.Exit(1)
+	}
+
+	addDiscoveredConfig(".")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	file, err := composeConfig(ctx, filepath.SplitList(composeFile), services)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	override, err := generateCompose(ctx, file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error generating mods:", err)
+		os.Exit(2)
+	}
+
+	data, err := override.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Print(string(data))
+}
+
+// newOptions creates the options for Generate from the flags and env vars.
+func newOptions(buildArgs map[string]string, target string, buildContexts map[string]string) gnarly.Options {
+	return gnarly.Options{
+		BuildArgs:     buildArgs,
+		Target:        target,
+		BuildContexts: buildContexts,
+		Platform:      singlePlatform(strings.Split(buildkitPlatform, ",")),
+		ModProg:       modProg,
+		ModProtocol:   modProtocol,
+		ModTimeout:    modTimeout,
+		ModOnError:    modOnError,
+		ModConfig:     modConfigPaths(),
+		ModTable:      filepath.SplitList(modTable),
+		MaxRulePasses: modMaxRulePasses,
+		Policy:        policyMode,
+		Jobs:          modJobs,
+		NoModCache:    noModCache || modCacheTTL == 0,
+		ModCacheTTL:   modCacheTTL,
+		Pin:           pinMode,
+		ResolveConfig: resolveConfig,
+		Logger:        cliLogger{},
+		Stderr:        os.Stderr,
+	}
+}
+
+// cliLogger prints debug output when debugging is enabled and always prints warnings.
+type cliLogger struct{}
+
+func (cliLogger) Debug(args ...interface{}) {
+	debug(args...)
+}
+
+func (cliLogger) Warn(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, append([]interface{}{"warning:"}, args...)...)
+}
+
+// envDuration parses a duration from the env var, returning the default value if it is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid duration for %s, using default %s: %v\n", key, def, err)
+		return def
+	}
+	return d
+}
+
+// envInt parses an int from the env var, returning the default value if it is unset or invalid.
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid value for %s, using default %d: %v\n", key, def, err)
+		return def
+	}
+	return i
+}
+
+// listFlag is a flag which can be passed multiple times, the values are joined with the OS path list separator.
+// Values passed on the command line replace the default value rather than adding to it.
+type listFlag struct {
+	v   *string
+	set bool
+}
+
+func (f *listFlag) Set(val string) error {
+	if !f.set {
+		*f.v = val
+		f.set = true
+		return nil
+	}
+	*f.v += string(os.PathListSeparator) + val
+	return nil
+}
+
+func (f *listFlag) String() string {
+	if f.v == nil {
+		return ""
+	}
+	return *f.v
+}
+
 type argFlag map[string]string
 
 func (f *argFlag) Set(val string) error {
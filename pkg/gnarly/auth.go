@@ -0,0 +1,150 @@
+package gnarly
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dockerHubHost      = "registry-1.docker.io"
+	dockerHubConfigKey = "https://index.docker.io/v1/"
+
+	// Username returned by credential helpers when the secret is an identity token.
+	identityTokenUsername = "<token>"
+)
+
+// dockerConfig is the subset of the docker cli config file (`~/.docker/config.json`) that is needed for registry auth.
+type dockerConfig struct {
+	Auths       map[string]dockerAuthConfig `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type dockerAuthConfig struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+func loadDockerConfig() (*dockerConfig, error) {
+	var cfg dockerConfig
+
+	dir := dockerConfigDir()
+	if dir == "" {
+		return &cfg, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &cfg, nil
+		}
+		return nil, fmt.Errorf("error reading docker config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing docker config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Credentials returns the username and secret for the registry host.
+// The signature matches what is expected by containerd's docker authorizer.
+// An empty username with a non-empty secret means the secret is an identity token.
+func (c *dockerConfig) Credentials(host string) (string, string, error) {
+	key := host
+	if host == dockerHubHost || host == "docker.io" {
+		key = dockerHubConfigKey
+	}
+
+	helper := c.CredsStore
+	if h, ok := c.CredHelpers[key]; ok {
+		helper = h
+	}
+	if helper != "" {
+		return credentialsFromHelper(helper, key)
+	}
+
+	auth, ok := c.Auths[key]
+	if !ok {
+		// Entries may be stored with a scheme, e.g. `https://myregistry.io`
+		for k, v := range c.Auths {
+			if strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(k, "https://"), "http://"), "/") == key {
+				auth, ok = v, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return "", "", nil
+	}
+
+	if auth.IdentityToken != "" {
+		return "", auth.IdentityToken, nil
+	}
+
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("error decoding auth for %s from docker config: %w", host, err)
+		}
+		split := strings.SplitN(string(decoded), ":", 2)
+		if len(split) != 2 {
+			return "", "", fmt.Errorf("invalid auth for %s in docker config", host)
+		}
+		return split[0], split[1], nil
+	}
+
+	return auth.Username, auth.Password, nil
+}
+
+// credentialsFromHelper uses the docker credential helper protocol to look up credentials.
+// See https://github.com/docker/docker-credential-helpers
+func credentialsFromHelper(helper, serverURL string) (string, string, error) {
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(out, "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("error getting credentials for %s from helper %s: %s: %w", serverURL, helper, out, err)
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return "", "", fmt.Errorf("error parsing credentials from helper %s: %w", helper, err)
+	}
+
+	if creds.Username == identityTokenUsername {
+		return "", creds.Secret, nil
+	}
+	return creds.Username, creds.Secret, nil
+}
@@ -0,0 +1,52 @@
+package gnarly
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// BakeFile is a `docker buildx bake` file in the JSON format.
+// Only the fields needed to find the sources of a target (or to override its contexts) are included.
+type BakeFile struct {
+	Target map[string]BakeTarget `json:"target"`
+}
+
+// BakeTarget is a target in a bake file.
+type BakeTarget struct {
+	Context          string            `json:"context,omitempty"`
+	Dockerfile       string            `json:"dockerfile,omitempty"`
+	DockerfileInline string            `json:"dockerfile-inline,omitempty"`
+	Args             map[string]string `json:"args,omitempty"`
+	// Target is the build target in the Dockerfile
+	Target    string            `json:"target,omitempty"`
+	Contexts  map[string]string `json:"contexts,omitempty"`
+	Platforms []string          `json:"platforms,omitempty"`
+}
+
+// ParseBakeFile parses a bake file in the JSON format, such as the output of `docker buildx bake --print`.
+func ParseBakeFile(data []byte) (BakeFile, error) {
+	var f BakeFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return BakeFile{}, fmt.Errorf("error parsing bake file: %w", err)
+	}
+	return f, nil
+}
+
+// BakeContexts gets the contexts to set on a bake target for the replacements of the sources.
+// Returns nil if none of the sources can be replaced with a named context.
+func BakeContexts(sources []Source) map[string]string {
+	var contexts map[string]string
+	for _, s := range sources {
+		bc, ok := s.BuildContext()
+		if !ok {
+			continue
+		}
+		if contexts == nil {
+			contexts = make(map[string]string)
+		}
+		name, value, _ := strings.Cut(bc, "=")
+		contexts[name] = value
+	}
+	return contexts
+}
@@ -0,0 +1,26 @@
+package gnarly
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBakeContexts(t *testing.T) {
+	sources := []Source{
+		{Type: SourceTypeDockerImage, Ref: "docker.io/library/golang:1.18", Replace: "mcr.microsoft.com/oss/go/microsoft/golang:1.18"},
+		{Type: SourceTypeDockerImage, Ref: "docker.io/library/alpine:3.16"},
+		{Type: SourceTypeLocal, Ref: "../deps", Name: "deps", Replace: "https://github.com/example/deps.git"},
+		{Type: SourceTypeHTTP, Ref: "https://example.com/foo.tar.gz", Replace: "https://mirror.example.com/foo.tar.gz"},
+	}
+	expected := map[string]string{
+		"docker.io/library/golang:1.18": "docker-image://mcr.microsoft.com/oss/go/microsoft/golang:1.18",
+		"deps":                          "https://github.com/example/deps.git",
+	}
+	if contexts := BakeContexts(sources); !reflect.DeepEqual(contexts, expected) {
+		t.Fatalf("expected %v, got %v", expected, contexts)
+	}
+
+	if contexts := BakeContexts(sources[1:2]); contexts != nil {
+		t.Fatalf("expected no contexts, got %v", contexts)
+	}
+}
@@ -0,0 +1,70 @@
+package gnarly
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ComposeFile is a docker compose file.
+// Only the fields needed to find the sources of a service (or to override them) are included.
+type ComposeFile struct {
+	Services map[string]ComposeService `yaml:"services"`
+}
+
+// ComposeService is a service in a compose file.
+type ComposeService struct {
+	// Image is the image the service runs, or the name of the built image for services with a build
+	Image    string        `yaml:"image,omitempty"`
+	Platform string        `yaml:"platform,omitempty"`
+	Build    *ComposeBuild `yaml:"build,omitempty"`
+}
+
+// ComposeBuild is how the image for a service is built, this is in the long form compose uses once a file is normalized.
+type ComposeBuild struct {
+	Context            string            `yaml:"context,omitempty"`
+	Dockerfile         string            `yaml:"dockerfile,omitempty"`
+	DockerfileInline   string            `yaml:"dockerfile_inline,omitempty"`
+	Args               map[string]string `yaml:"args,omitempty"`
+	Target             string            `yaml:"target,omitempty"`
+	AdditionalContexts map[string]string `yaml:"additional_contexts,omitempty"`
+	Platforms          []string          `yaml:"platforms,omitempty"`
+}
+
+// ParseComposeFile parses a normalized compose file, such as the output of `docker compose config`.
+func ParseComposeFile(data []byte) (ComposeFile, error) {
+	var f ComposeFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return ComposeFile{}, fmt.Errorf("error parsing compose file: %w", err)
+	}
+	return f, nil
+}
+
+// Marshal encodes the compose file as YAML.
+func (f ComposeFile) Marshal() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ComposeImage gets the replacement for the source to use as the image of a service.
+// Returns false if there is no replacement or it is not an image.
+func ComposeImage(s Source) (string, bool) {
+	if s.Replace == "" || s.Type != SourceTypeDockerImage {
+		return "", false
+	}
+	v := contextValue(s.Type, s.Replace)
+	if !strings.HasPrefix(v, SourceTypeDockerImage+"://") {
+		return "", false
+	}
+	return strings.TrimPrefix(v, SourceTypeDockerImage+"://"), true
+}
@@ -0,0 +1,58 @@
+package gnarly
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseComposeFile(t *testing.T) {
+	f, err := ParseComposeFile([]byte(`
+name: app
+services:
+  app:
+    build:
+      context: /src/app
+      dockerfile: build.Dockerfile
+      args:
+        GO_VERSION: "1.18"
+      additional_contexts:
+        deps: ../deps
+    image: example.com/app
+  db:
+    image: postgres:14
+    platform: linux/arm64
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ComposeFile{Services: map[string]ComposeService{
+		"app": {Image: "example.com/app", Build: &ComposeBuild{
+			Context:            "/src/app",
+			Dockerfile:         "build.Dockerfile",
+			Args:               map[string]string{"GO_VERSION": "1.18"},
+			AdditionalContexts: map[string]string{"deps": "../deps"},
+		}},
+		"db": {Image: "postgres:14", Platform: "linux/arm64"},
+	}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, f)
+	}
+}
+
+func TestComposeImage(t *testing.T) {
+	for _, tc := range []struct {
+		source   Source
+		expected string
+	}{
+		{Source{Type: SourceTypeDockerImage, Ref: "docker.io/library/postgres:14", Replace: "mirror.example.com/postgres:14"}, "mirror.example.com/postgres:14"},
+		{Source{Type: SourceTypeDockerImage, Ref: "docker.io/library/postgres:14", Replace: "docker-image://mirror.example.com/postgres:14"}, "mirror.example.com/postgres:14"},
+		{Source{Type: SourceTypeDockerImage, Ref: "docker.io/library/postgres:14", Replace: "oci-layout:///layouts/postgres"}, ""},
+		{Source{Type: SourceTypeDockerImage, Ref: "docker.io/library/postgres:14"}, ""},
+	} {
+		image, ok := ComposeImage(tc.source)
+		if image != tc.expected || ok != (tc.expected != "") {
+			t.Errorf("%s: expected %q, got %q (%v)", tc.source.Replace, tc.expected, image, ok)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package gnarly
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ConfigFileNames are the names of repo-local mod configs which are discovered automatically, in order of preference.
+var ConfigFileNames = []string{".gnarly.json", ".gnarly.yaml", ".gnarly.yml", ".gnarly.toml"}
+
+// DiscoverConfig looks for a repo-local mod config in the passed in dirs, which are searched in order.
+// Returns an empty string if none is found.
+func DiscoverConfig(dirs ...string) string {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		for _, name := range ConfigFileNames {
+			p := filepath.Join(dir, name)
+			if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+				return p
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package gnarly
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiscoverConfig(t *testing.T) {
+	ctxDir := t.TempDir()
+	subDir := filepath.Join(ctxDir, "build")
+	if err := os.Mkdir(subDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{filepath.Join(ctxDir, ".gnarly.yaml"), filepath.Join(subDir, ".gnarly.toml"), filepath.Join(subDir, ".gnarly.json")} {
+		if err := os.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if p := DiscoverConfig(subDir, ctxDir); p != filepath.Join(subDir, ".gnarly.json") {
+		t.Errorf("unexpected config: %s", p)
+	}
+	if p := DiscoverConfig("", ctxDir); p != filepath.Join(ctxDir, ".gnarly.yaml") {
+		t.Errorf("unexpected config: %s", p)
+	}
+	if p := DiscoverConfig(t.TempDir()); p != "" {
+		t.Errorf("expected no config, got: %s", p)
+	}
+}
@@ -0,0 +1,139 @@
+package gnarly
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	ResolverRules   = "rules"
+	ResolverModProg = "mod-prog"
+	ResolverCache   = "cache"
+	ResolverTable   = "table"
+	// ResolverReplacer is used for a Replacer passed in Options, unless it is one of the replacers from this package
+	ResolverReplacer = "replacer"
+)
+
+// Explanation describes how the replacement for a source was resolved.
+type Explanation struct {
+	Type string `json:"type"`
+	// Ref is the normalized ref of the source
+	Ref    string   `json:"ref"`
+	Name   string   `json:"name,omitempty"`
+	Stages []string `json:"stages,omitempty"`
+	// Resolver is what produced the replacement: `rules` for the builtin matcher, `mod-prog`, `table` for a lookup table, `cache` for a cached replacement from the mod-prog, or `replacer` for a custom Replacer.
+	// It is empty when there is nothing to resolve replacements with.
+	Resolver string `json:"resolver,omitempty"`
+	// Program is the mod-prog, if it was used
+	Program  string `json:"program,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	// Rules are the indexes of the rules which matched
+	Rules []int `json:"rules,omitempty"`
+	// Tried is every rule which was tried, in order
+	Tried []RuleTrial `json:"tried,omitempty"`
+	// Error is the mod-prog error which was skipped or fell back to the builtin matcher
+	Error   string `json:"error,omitempty"`
+	Replace string `json:"replace,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Pinned  bool   `json:"pinned,omitempty"`
+	// Final is the ref which is used for the build, the replacement or the ref itself
+	Final string `json:"final"`
+}
+
+// RuleTrial is a rule the builtin matcher tried for a ref.
+type RuleTrial struct {
+	// Pass is the pass over the rules, starting at 1, which only goes above 1 for chained rules
+	Pass int `json:"pass"`
+	// Index is the position of the rule once all the mod configs are merged
+	Index int    `json:"index"`
+	Rule  string `json:"rule"`
+	// File is the mod config the rule is from
+	File    string `json:"file,omitempty"`
+	Ref     string `json:"ref"`
+	Matched bool   `json:"matched"`
+	Result  string `json:"result,omitempty"`
+}
+
+func (e *Explanation) addTrials(trials []RuleTrial) {
+	for _, t := range trials {
+		if t.Matched {
+			e.Rules = append(e.Rules, t.Index)
+		}
+	}
+	e.Tried = append(e.Tried, trials...)
+}
+
+type explainKey struct{}
+
+// withExplanations sets the function replacers use to find the explanation for a source.
+func withExplanations(ctx context.Context, explain func(Source) *Explanation) context.Context {
+	return context.WithValue(ctx, explainKey{}, explain)
+}
+
+// explanationFor gets the explanation for a source which replacers record how it was resolved in, this is nil when nothing is being explained.
+func explanationFor(ctx context.Context, s Source) *Explanation {
+	explain, ok := ctx.Value(explainKey{}).(func(Source) *Explanation)
+	if !ok {
+		return nil
+	}
+	return explain(s)
+}
+
+// WriteExplanations writes the explanations in a human readable form.
+func WriteExplanations(w io.Writer, explanations []Explanation) error {
+	sb := &strings.Builder{}
+	for i, e := range explanations {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(sb, "%s %s\n", e.Type, e.Ref)
+		if e.Name != "" {
+			fmt.Fprintf(sb, "  context:  %s\n", e.Name)
+		}
+		if len(e.Stages) > 0 {
+			fmt.Fprintf(sb, "  stages:   %s\n", strings.Join(e.Stages, ", "))
+		}
+
+		resolver := e.Resolver
+		switch {
+		case resolver == "":
+			resolver = "none"
+		case e.Program != "":
+			resolver += " (" + e.Program
+			if e.Protocol != "" {
+				resolver += ", " + e.Protocol + " protocol"
+			}
+			resolver += ")"
+		}
+		fmt.Fprintf(sb, "  resolver: %s\n", resolver)
+		if e.Error != "" {
+			fmt.Fprintf(sb, "  error:    %s\n", e.Error)
+		}
+
+		for _, t := range e.Tried {
+			rule := fmt.Sprintf("rule %d (%s)", t.Index, t.Rule)
+			if t.File != "" {
+				rule += " from " + t.File
+			}
+			if t.Matched {
+				fmt.Fprintf(sb, "  pass %d:   %s matched %s -> %s\n", t.Pass, rule, t.Ref, t.Result)
+			} else {
+				fmt.Fprintf(sb, "  pass %d:   %s did not match %s\n", t.Pass, rule, t.Ref)
+			}
+		}
+		if e.Reason != "" {
+			fmt.Fprintf(sb, "  reason:   %s\n", e.Reason)
+		}
+		if e.Replace == "" {
+			fmt.Fprintf(sb, "  final:    %s (not replaced)\n", e.Final)
+		} else if e.Pinned {
+			fmt.Fprintf(sb, "  final:    %s (pinned)\n", e.Final)
+		} else {
+			fmt.Fprintf(sb, "  final:    %s\n", e.Final)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,100 @@
+package gnarly
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerateExplain(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	modConfig := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(modConfig, []byte(`
+- description: mirror
+  match: ^docker.io/library/(.*)$
+  replace: mirror.example.com/$1
+  chain: true
+- id: golang-patch
+  match: ^mirror.example.com/golang:1.18$
+  replace: mirror.example.com/golang:1.18.3
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dockerfile := []byte(`
+FROM golang:1.18 AS build
+FROM ghcr.io/foo/bar:1
+COPY --from=build / /
+`)
+
+	t.Run("rules", func(t *testing.T) {
+		result, err := Generate(context.Background(), dockerfile, Options{ModConfig: []string{modConfig}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []Explanation{
+			{
+				Type:     "docker-image",
+				Ref:      "docker.io/library/golang:1.18",
+				Stages:   []string{"build"},
+				Resolver: ResolverRules,
+				Rules:    []int{0, 1},
+				Tried: []RuleTrial{
+					{Pass: 1, Index: 0, Rule: "mirror", File: modConfig, Ref: "docker.io/library/golang:1.18", Matched: true, Result: "mirror.example.com/golang:1.18"},
+					{Pass: 2, Index: 0, Rule: "mirror", File: modConfig, Ref: "mirror.example.com/golang:1.18"},
+					{Pass: 2, Index: 1, Rule: "golang-patch", File: modConfig, Ref: "mirror.example.com/golang:1.18", Matched: true, Result: "mirror.example.com/golang:1.18.3"},
+				},
+				Replace: "mirror.example.com/golang:1.18.3",
+				Final:   "mirror.example.com/golang:1.18.3",
+			},
+			{
+				Type:     "docker-image",
+				Ref:      "ghcr.io/foo/bar:1",
+				Stages:   []string{"stage-1"},
+				Resolver: ResolverRules,
+				Tried: []RuleTrial{
+					{Pass: 1, Index: 0, Rule: "mirror", File: modConfig, Ref: "ghcr.io/foo/bar:1"},
+					{Pass: 1, Index: 1, Rule: "golang-patch", File: modConfig, Ref: "ghcr.io/foo/bar:1"},
+				},
+				Final: "ghcr.io/foo/bar:1",
+			},
+		}
+		if !reflect.DeepEqual(result.Explanations, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, result.Explanations)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := WriteExplanations(buf, result.Explanations); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{
+			"pass 2:   rule 1 (golang-patch) from " + modConfig + " matched mirror.example.com/golang:1.18 -> mirror.example.com/golang:1.18.3",
+			"final:    ghcr.io/foo/bar:1 (not replaced)",
+		} {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("expected output to contain %q, got:\n%s", s, buf)
+			}
+		}
+	})
+
+	t.Run("mod prog", func(t *testing.T) {
+		modProg := writeModProg(t, `echo "$1" | sed s/docker.io/mirror.example.com/`)
+
+		for _, resolver := range []string{ResolverModProg, ResolverCache} {
+			result, err := Generate(context.Background(), dockerfile, Options{ModProg: modProg, ModConfig: []string{modConfig}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := result.Explanations[0]
+			if e.Resolver != resolver || e.Program != modProg || e.Final != "mirror.example.com/library/golang:1.18" || len(e.Tried) != 0 {
+				t.Errorf("unexpected explanation: %+v", e)
+			}
+		}
+	})
+}
@@ -0,0 +1,427 @@
+package gnarly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	binfotypes "github.com/moby/buildkit/util/buildinfo/types"
+)
+
+type Source struct {
+	// Type is the buildkit source type, e.g. `docker-image`, `git`, `http` or `local`
+	Type    string `json:"type"`
+	Ref     string `json:"ref"`
+	Replace string `json:"replace,omitempty"`
+	// Name is the named build context the source was provided with, if any
+	Name string `json:"name,omitempty"`
+	// Targets is the list of build targets which use the source
+	Targets []string `json:"targets,omitempty"`
+	// Stages is the list of stages which use the source
+	Stages []string `json:"stages,omitempty"`
+	// Uses is the list of ways the source is used by the stages, e.g. `from` for a base image or `copy` for `COPY --from`
+	Uses []string `json:"uses,omitempty"`
+	// Reason is an explanation for the replacement, as returned by the mod-prog
+	Reason string `json:"reason,omitempty"`
+	// Metadata is any extra data returned by the mod-prog for the source
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+type Result struct {
+	Sources []Source `json:"sources"`
+	// Explanations describe how each source was resolved, in the same order as Sources
+	Explanations []Explanation `json:"-"`
+}
+
+// Generate finds all the sources used by the Dockerfile and resolves replacements for them.
+func Generate(ctx context.Context, dt []byte, opts Options) (Result, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return Result{}, err
+	}
+	log := opts.Logger
+
+	targets, err := dockerfile2llb.ListTargets(context.TODO(), dt)
+	if err != nil {
+		return Result{}, fmt.Errorf("error listing dockerfile targets: %w", err)
+	}
+
+	stages, err := parseStages(dt, opts.BuildArgs)
+	if err != nil {
+		return Result{}, fmt.Errorf("error parsing dockerfile: %w", err)
+	}
+
+	var configs *imageConfigFetcher
+	if opts.ResolveConfig {
+		configs, err = newImageConfigFetcher(log)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	namedContexts := make(map[string]string, len(opts.BuildContexts))
+	for k, v := range opts.BuildContexts {
+		namedContexts[contextName(k)] = v
+	}
+
+	type sourceKey struct {
+		Type string
+		Ref  string
+		Name string
+	}
+
+	// namedSource gets the source for the named context which provides the stage or image name
+	// Contexts which are other bake targets are returned too, since they still replace the stage or image, but they are not recorded as sources.
+	namedSource := func(name string) (sourceKey, bool) {
+		name = contextName(name)
+		v, ok := namedContexts[name]
+		if !ok {
+			return sourceKey{}, false
+		}
+		typ, ref := ContextSource(v)
+		return sourceKey{Type: typ, Ref: ref, Name: name}, true
+	}
+
+	var found bool
+	refTargets := make(map[sourceKey][]string)
+	reachable := make(map[string]struct{})
+	for _, t := range targets.Targets {
+		name := t.Name
+		if t.Default && name == "" {
+			name = stages[len(stages)-1].Name
+		}
+		if opts.Target != "" && !strings.EqualFold(opts.Target, name) {
+			continue
+		}
+		found = true
+
+		r := newResolver(log)
+		r.configs = configs
+		targetSources := make(map[sourceKey]struct{})
+
+		targetStages := reachableStages(stages, name)
+		for _, st := range stages {
+			if _, ok := targetStages[st.Name]; !ok {
+				continue
+			}
+			reachable[st.Name] = struct{}{}
+			// Named contexts are looked up by the frontend for every stage, so only record the ones reachable stages use.
+			if k, ok := namedSource(st.Name); ok && k.Type != contextTypeTarget {
+				targetSources[k] = struct{}{}
+			}
+			for _, src := range st.Sources {
+				if k, ok := namedSource(src.Ref); ok && src.Type == SourceTypeDockerImage {
+					if k.Type != contextTypeTarget {
+						targetSources[k] = struct{}{}
+					}
+					continue
+				}
+				switch {
+				case src.Type != SourceTypeDockerImage:
+					targetSources[sourceKey{Type: src.Type, Ref: src.Ref}] = struct{}{}
+				case src.Kind == useOnbuild:
+					// Images in ONBUILD triggers are not resolved as part of the build, so they need to be added here.
+					r.refs[src.Ref] = src.Ref
+				}
+			}
+		}
+
+		_, err = dockerfile2llb.Dockefile2Outline(ctx, dt, dockerfile2llb.ConvertOpt{
+			BuildArgs: func() map[string]string {
+				if len(opts.BuildArgs) > 0 {
+					return opts.BuildArgs
+				}
+				return nil
+			}(),
+			Target:       t.Name,
+			MetaResolver: r,
+			ContextByName: func(ctx context.Context, name, resolveMode string) (*llb.State, *dockerfile2llb.Image, *binfotypes.BuildInfo, error) {
+				if _, ok := namedSource(name); !ok {
+					return nil, nil, nil, nil
+				}
+				// The state is never solved, it only needs to stop the frontend from resolving the image the context replaces.
+				st := llb.Scratch()
+				return &st, nil, nil, nil
+			},
+		})
+		if err != nil {
+			return Result{}, fmt.Errorf("error parsing dockerfile: %w", err)
+		}
+
+		for ref := range r.refs {
+			targetSources[sourceKey{Type: SourceTypeDockerImage, Ref: ref}] = struct{}{}
+		}
+		for k := range targetSources {
+			refTargets[k] = append(refTargets[k], name)
+		}
+	}
+	if !found {
+		if opts.Target != "" {
+			return Result{}, fmt.Errorf("target stage %s could not be found", opts.Target)
+		}
+		// A Dockerfile with no stages has no sources
+		return Result{}, nil
+	}
+
+	var pin *pinner
+	if opts.Pin != "" {
+		pin, err = newPinner(log)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	var result Result
+
+	var (
+		rules *ruleSet
+		table TableReplacer
+	)
+	// The mod config is only used by the builtin matchers when there is no mod-prog or replacer, or as a fallback when the mod-prog fails.
+	// Otherwise the config may be in a format only the mod-prog understands, so it is only read for policy rules when the policy mode is set explicitly.
+	useRules := opts.Replacer == nil && (opts.ModProg == "" || opts.ModOnError == ModOnErrorBuiltin)
+	if (useRules || (opts.Policy != "" && opts.Policy != PolicyOff)) && (len(opts.ModConfig) > 0 || len(opts.Rules) > 0) {
+		rules, table, err = loadRules(opts.ModConfig, opts.Rules)
+		if err != nil {
+			return Result{}, err
+		}
+		rules.maxPasses = opts.MaxRulePasses
+		rules.log = log
+	}
+	builtin := &RulesReplacer{rules: rules, table: table, platform: opts.Platform}
+
+	// Lookup tables which are passed in explicitly are checked before anything else, later tables take precedence
+	var modTable TableReplacer
+	for _, p := range opts.ModTable {
+		t, err := LoadTable(p)
+		if err != nil {
+			return Result{}, err
+		}
+		modTable = modTable.merge(t)
+	}
+
+	// Explanations are created for every source before any replacements are resolved, so they can be updated concurrently for different sources
+	explanations := make(map[sourceKey]*Explanation)
+	explain := func(s Source) *Explanation {
+		return explanations[sourceKey{Type: s.Type, Ref: s.Ref, Name: s.Name}]
+	}
+	ctx = withExplanations(ctx, explain)
+
+	// Sources which the mod-prog failed for, these are never cached
+	var failedMu sync.Mutex
+	failed := make(map[sourceKey]struct{})
+
+	// onError applies the error policy to mod-prog failures for the passed in sources.
+	onError := func(err error, sources []Source) error {
+		var modErr *ModProgError
+		if !errors.As(err, &modErr) {
+			return err
+		}
+		failedMu.Lock()
+		for _, s := range sources {
+			failed[sourceKey{Type: s.Type, Ref: s.Ref, Name: s.Name}] = struct{}{}
+			explain(s).Error = err.Error()
+		}
+		failedMu.Unlock()
+		switch opts.ModOnError {
+		case ModOnErrorSkip:
+			log.Warn("skipping replacement:", err)
+		case ModOnErrorBuiltin:
+			log.Warn("falling back to builtin matchers:", err)
+			return builtin.Replace(ctx, sources)
+		default:
+			return err
+		}
+		return nil
+	}
+
+	var replacer Replacer
+	switch {
+	case opts.Replacer != nil:
+		replacer = opts.Replacer
+	case opts.ModProg != "":
+		replacer = &ProgReplacer{opts: opts, OnError: onError}
+	default:
+		replacer = builtin
+	}
+
+	for k, targets := range refTargets {
+		s := Source{Type: k.Type, Ref: k.Ref, Name: k.Name, Targets: targets}
+		sort.Strings(s.Targets)
+		uses := make(map[string]struct{})
+		for _, st := range stages {
+			if _, ok := reachable[st.Name]; !ok {
+				continue
+			}
+			var used bool
+			if k.Name != "" && contextName(st.Name) == k.Name {
+				// The context replaces the stage itself
+				used = true
+				uses[useFrom] = struct{}{}
+			}
+			for _, src := range st.Sources {
+				if k.Name != "" {
+					if src.Type != SourceTypeDockerImage || contextName(src.Ref) != k.Name {
+						continue
+					}
+				} else if src.Type != k.Type || src.Ref != k.Ref {
+					continue
+				}
+				used = true
+				uses[src.Kind] = struct{}{}
+			}
+			if used {
+				s.Stages = append(s.Stages, st.Name)
+			}
+		}
+		for u := range uses {
+			s.Uses = append(s.Uses, u)
+		}
+		sort.Strings(s.Uses)
+		result.Sources = append(result.Sources, s)
+	}
+
+	// Sort for stable output for testing
+	sort.Slice(result.Sources, func(i, j int) bool {
+		a, b := result.Sources[i], result.Sources[j]
+		if a.Ref != b.Ref {
+			return a.Ref < b.Ref
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Name < b.Name
+	})
+
+	result.Explanations = make([]Explanation, len(result.Sources))
+	for i, s := range result.Sources {
+		e := &result.Explanations[i]
+		*e = Explanation{Type: s.Type, Ref: s.Ref, Name: s.Name, Stages: s.Stages}
+		switch {
+		case opts.Replacer != nil:
+			e.Resolver = ResolverReplacer
+		case opts.ModProg != "":
+			e.Resolver = ResolverModProg
+			e.Program = opts.ModProg
+			e.Protocol = opts.ModProtocol
+		}
+		explanations[sourceKey{Type: s.Type, Ref: s.Ref, Name: s.Name}] = e
+	}
+
+	// Only sources which are not in a lookup table or cached are sent to the mod-prog
+	var (
+		cache      *modCache
+		pending    []Source
+		pendingIdx []int
+	)
+	if opts.Replacer == nil && opts.ModProg != "" && !opts.NoModCache {
+		cache, err = newModCache(&opts)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if err := modTable.Replace(ctx, result.Sources); err != nil {
+		return Result{}, err
+	}
+	for i := range result.Sources {
+		if result.Sources[i].Replace != "" {
+			continue
+		}
+		if cache != nil && cache.Get(&result.Sources[i]) {
+			log.Debug("using cached replacement for", result.Sources[i].Ref)
+			result.Explanations[i].Resolver = ResolverCache
+			continue
+		}
+		pending = append(pending, result.Sources[i])
+		pendingIdx = append(pendingIdx, i)
+	}
+
+	if len(pending) > 0 {
+		if err := replacer.Replace(ctx, pending); err != nil {
+			return Result{}, err
+		}
+	}
+
+	for i, s := range pending {
+		result.Sources[pendingIdx[i]] = s
+		if _, ok := failed[sourceKey{Type: s.Type, Ref: s.Ref, Name: s.Name}]; cache != nil && !ok {
+			cache.Put(s)
+		}
+	}
+
+	if err := checkPolicy(rules, result.Sources, &opts); err != nil {
+		return Result{}, err
+	}
+
+	err = parallel(len(result.Sources), opts.Jobs, func(i int) error {
+		s := &result.Sources[i]
+		if pin != nil && s.Type == SourceTypeDockerImage {
+			if s.Replace == "" && opts.Pin == PinAll {
+				s.Replace = s.Ref
+			}
+			// Only image replacements can be pinned
+			if v := contextValue(s.Type, s.Replace); s.Replace != "" && strings.HasPrefix(v, SourceTypeDockerImage+"://") {
+				pinned, err := pin.Pin(ctx, strings.TrimPrefix(v, SourceTypeDockerImage+"://"))
+				if err != nil {
+					return err
+				}
+				s.Replace = pinned
+				result.Explanations[i].Pinned = true
+			}
+		}
+		log.Debug("resolved", s.Type, s.Ref, "with replacement:", s.Replace)
+		return nil
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	for i, s := range result.Sources {
+		e := &result.Explanations[i]
+		e.Replace = s.Replace
+		e.Reason = s.Reason
+		e.Final = s.Ref
+		if s.Replace != "" {
+			e.Final = s.Replace
+		}
+	}
+
+	return result, nil
+}
+
+// parallel calls fn for every index up to n, with at most jobs calls running at once.
+// All calls are made even if one fails, the error for the lowest index is returned so errors are reported consistently.
+func parallel(n, jobs int, fn func(i int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	errs := make([]error, n)
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package gnarly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGenerateTargets(t *testing.T) {
+	dockerfile := []byte(`
+ARG BASE=busybox
+FROM ${BASE} AS base
+FROM golang:1.18 AS build
+COPY --from=base / /
+FROM base AS other
+FROM golang:1.18 AS lint
+FROM alpine
+COPY --from=build / /
+`)
+
+	t.Run("all targets", func(t *testing.T) {
+		result, err := Generate(context.Background(), dockerfile, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []Source{
+			{Type: "docker-image", Ref: "docker.io/library/alpine:latest", Targets: []string{"stage-4"}, Stages: []string{"stage-4"}, Uses: []string{"from"}},
+			{Type: "docker-image", Ref: "docker.io/library/busybox:latest", Targets: []string{"base", "build", "other", "stage-4"}, Stages: []string{"base"}, Uses: []string{"from"}},
+			{Type: "docker-image", Ref: "docker.io/library/golang:1.18", Targets: []string{"build", "lint", "stage-4"}, Stages: []string{"build", "lint"}, Uses: []string{"from"}},
+		}
+		if !reflect.DeepEqual(result.Sources, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+		}
+	})
+
+	t.Run("target", func(t *testing.T) {
+		result, err := Generate(context.Background(), dockerfile, Options{BuildArgs: map[string]string{"BASE": "alpine:3.16"}, Target: "other"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []Source{
+			{Type: "docker-image", Ref: "docker.io/library/alpine:3.16", Targets: []string{"other"}, Stages: []string{"base"}, Uses: []string{"from"}},
+		}
+		if !reflect.DeepEqual(result.Sources, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+		}
+	})
+
+	t.Run("unreachable stages", func(t *testing.T) {
+		result, err := Generate(context.Background(), dockerfile, Options{Target: "build"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []Source{
+			{Type: "docker-image", Ref: "docker.io/library/busybox:latest", Targets: []string{"build"}, Stages: []string{"base"}, Uses: []string{"from"}},
+			{Type: "docker-image", Ref: "docker.io/library/golang:1.18", Targets: []string{"build"}, Stages: []string{"build"}, Uses: []string{"from"}},
+		}
+		if !reflect.DeepEqual(result.Sources, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+		}
+	})
+
+	t.Run("missing target", func(t *testing.T) {
+		if _, err := Generate(context.Background(), dockerfile, Options{Target: "missing"}); err == nil {
+			t.Fatal("expected error for missing target")
+		}
+	})
+
+	t.Run("no stages", func(t *testing.T) {
+		dockerfile := []byte("ARG BASE=busybox\n")
+		result, err := Generate(context.Background(), dockerfile, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Sources) != 0 {
+			t.Fatalf("expected no sources, got %+v", result.Sources)
+		}
+		if _, err := Generate(context.Background(), dockerfile, Options{Target: "build"}); err == nil {
+			t.Fatal("expected error for missing target")
+		}
+	})
+}
+
+func TestGenerateNonFromSources(t *testing.T) {
+	dockerfile := []byte(`
+FROM busybox AS tools
+COPY --from=alpine:3.16 / /
+RUN --mount=type=bind,from=golang:1.18,target=/go true
+RUN --mount=type=cache,from=node:18,target=/cache true
+ONBUILD COPY --from=nginx:1 / /
+ONBUILD COPY --from=0 / /
+
+FROM alpine:3.16
+COPY --from=tools / /
+`)
+
+	result, err := Generate(context.Background(), dockerfile, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Source{
+		{Type: "docker-image", Ref: "docker.io/library/alpine:3.16", Targets: []string{"stage-1", "tools"}, Stages: []string{"tools", "stage-1"}, Uses: []string{"copy", "from"}},
+		{Type: "docker-image", Ref: "docker.io/library/busybox:latest", Targets: []string{"stage-1", "tools"}, Stages: []string{"tools"}, Uses: []string{"from"}},
+		{Type: "docker-image", Ref: "docker.io/library/golang:1.18", Targets: []string{"stage-1", "tools"}, Stages: []string{"tools"}, Uses: []string{"mount"}},
+		{Type: "docker-image", Ref: "docker.io/library/nginx:1", Targets: []string{"stage-1", "tools"}, Stages: []string{"tools"}, Uses: []string{"onbuild"}},
+		{Type: "docker-image", Ref: "docker.io/library/node:18", Targets: []string{"stage-1", "tools"}, Stages: []string{"tools"}, Uses: []string{"mount"}},
+	}
+	if !reflect.DeepEqual(result.Sources, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+	}
+}
+
+func TestGenerateOnbuildSources(t *testing.T) {
+	modConfig := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(modConfig, []byte(`
+- match: ^docker.io/library/nginx:(.*)$
+  replace: mcr.microsoft.com/mirror/docker/library/nginx:$1
+- action: deny
+  match: ^docker.io/library/redis
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{ModConfig: []string{modConfig}}
+
+	// Images only used by ONBUILD triggers are reported, but not passed to the build or checked against policy
+	result, err := Generate(context.Background(), []byte(`
+FROM alpine:3.16
+ONBUILD COPY --from=nginx:1 / /
+ONBUILD COPY --from=redis:7 / /
+`), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replaced bool
+	for _, s := range result.Sources {
+		if s.Ref != "docker.io/library/nginx:1" {
+			continue
+		}
+		replaced = s.Replace == "mcr.microsoft.com/mirror/docker/library/nginx:1"
+		if bc, ok := s.BuildContext(); ok {
+			t.Errorf("expected no build context for onbuild source, got %s", bc)
+		}
+	}
+	if !replaced {
+		t.Errorf("expected onbuild source to be replaced, got %+v", result.Sources)
+	}
+
+	// Images which are also used by the build itself are still checked
+	_, err = Generate(context.Background(), []byte(`
+FROM redis:7
+ONBUILD COPY --from=redis:7 / /
+`), opts)
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("expected PolicyError, got: %v", err)
+	}
+}
+
+func TestGenerateSourceTypes(t *testing.T) {
+	dockerfile := []byte(`
+FROM golang:1.18 AS build
+ADD https://example.com/tool.tar.gz /tmp/
+ADD git@github.com:moby/buildkit.git#v0.10.0 /src
+ADD local.txt /
+
+FROM alpine:3.16
+COPY --from=build / /
+COPY --from=deps / /deps
+`)
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	config := `[
+	{"match": "^https://example.com/(.*)$", "replace": "https://mirror.example.com/$1", "type": "http"},
+	{"match": "^git@github.com:moby/buildkit.git(.*)$", "replace": "https://git.example.com/moby/buildkit.git$1", "type": "git"},
+	{"match": "^/src/deps$", "replace": "/src/other-deps", "type": "local"},
+	{"match": "^docker.io/library/golang:1.18$", "replace": "mcr.microsoft.com/oss/go/golang:1.18"}
+]`
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Generate(context.Background(), dockerfile, Options{
+		ModConfig: []string{configPath},
+		BuildContexts: map[string]string{
+			"deps":        "/src/deps",
+			"alpine:3.16": "docker-image://docker.io/library/alpine:3.17",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Source{
+		{Type: "local", Ref: "/src/deps", Replace: "/src/other-deps", Name: "deps", Targets: []string{"stage-1"}, Stages: []string{"stage-1"}, Uses: []string{"copy"}},
+		{Type: "docker-image", Ref: "docker.io/library/alpine:3.17", Name: "alpine:3.16", Targets: []string{"stage-1"}, Stages: []string{"stage-1"}, Uses: []string{"from"}},
+		{Type: "docker-image", Ref: "docker.io/library/golang:1.18", Replace: "mcr.microsoft.com/oss/go/golang:1.18", Targets: []string{"build", "stage-1"}, Stages: []string{"build"}, Uses: []string{"from"}},
+		{Type: "git", Ref: "git@github.com:moby/buildkit.git#v0.10.0", Replace: "https://git.example.com/moby/buildkit.git#v0.10.0", Targets: []string{"build", "stage-1"}, Stages: []string{"build"}, Uses: []string{"add"}},
+		{Type: "http", Ref: "https://example.com/tool.tar.gz", Replace: "https://mirror.example.com/tool.tar.gz", Targets: []string{"build", "stage-1"}, Stages: []string{"build"}, Uses: []string{"add"}},
+	}
+	if !reflect.DeepEqual(result.Sources, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+	}
+}
+
+func TestGenerateNamedImageContext(t *testing.T) {
+	dockerfile := []byte("FROM alpine:3.16\n")
+	opts := Options{BuildContexts: map[string]string{"alpine:3.16": "docker-image://debian:11"}}
+
+	modConfig := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(t *testing.T, data string) {
+		t.Helper()
+		if err := os.WriteFile(modConfig, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts.ModConfig = []string{modConfig}
+
+	t.Run("rule", func(t *testing.T) {
+		writeConfig(t, `
+- match: ^docker.io/library/debian:(.*)$
+  replace: mcr.microsoft.com/mirror/docker/library/debian:$1
+`)
+		result, err := Generate(context.Background(), dockerfile, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []Source{
+			{Type: "docker-image", Ref: "docker.io/library/debian:11", Replace: "mcr.microsoft.com/mirror/docker/library/debian:11", Name: "alpine:3.16", Targets: []string{"stage-0"}, Stages: []string{"stage-0"}, Uses: []string{"from"}},
+		}
+		if !reflect.DeepEqual(result.Sources, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+		}
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		writeConfig(t, `
+- action: deny
+  match: ^docker.io/library/debian
+`)
+		_, err := Generate(context.Background(), dockerfile, opts)
+		var policyErr *PolicyError
+		if !errors.As(err, &policyErr) {
+			t.Fatalf("expected PolicyError, got: %v", err)
+		}
+	})
+}
+
+func TestParallel(t *testing.T) {
+	var running, max int32
+	seen := make([]bool, 20)
+	err := parallel(len(seen), 3, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		seen[i] = true
+		if i == 7 || i == 4 {
+			return fmt.Errorf("error %d", i)
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "error 4" {
+		t.Errorf("expected error for lowest index, got: %v", err)
+	}
+	if max > 3 {
+		t.Errorf("expected at most 3 calls at once, got %d", max)
+	}
+	for i, ok := range seen {
+		if !ok {
+			t.Errorf("expected call for index %d", i)
+		}
+	}
+}
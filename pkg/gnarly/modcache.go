@@ -0,0 +1,171 @@
+package gnarly
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultModCacheTTL is how long replacements from the mod-prog are cached for.
+const DefaultModCacheTTL = 24 * time.Hour
+
+// modCache stores replacements from the mod-prog on disk so repeated runs do not need to call the mod-prog again.
+// Entries are keyed by the source, the identity of the mod-prog and the content of the mod configs, so changing any of those invalidates the cache.
+// With the JSON protocols everything else sent in the request (the platform, build args and the context of the source) is part of the key too.
+type modCache struct {
+	dir      string
+	identity string
+	ttl      time.Duration
+	log      Logger
+	// sourceContext is set when the mod-prog is also sent the targets, stages and uses of each source, so they are part of the key
+	sourceContext bool
+}
+
+type cachedReplacement struct {
+	Replace  string          `json:"replace,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	Created  time.Time       `json:"created"`
+}
+
+func modCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gnarly", "mod"), nil
+}
+
+func newModCache(opts *Options) (*modCache, error) {
+	dir, err := modCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("error getting mod cache dir: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("error creating mod cache dir: %w", err)
+	}
+
+	identity, err := modIdentity(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &modCache{
+		dir:           dir,
+		identity:      identity,
+		ttl:           opts.ModCacheTTL,
+		log:           opts.Logger,
+		sourceContext: opts.ModProtocol == ModProtocolJSON || opts.ModProtocol == ModProtocolPlugin,
+	}, nil
+}
+
+// modIdentity gets a string which changes whenever the mod-prog, how it is called, or the mod config changes.
+// The mod-prog binary is identified by its path, size and modification time rather than its content since it may be large.
+func modIdentity(opts *Options) (string, error) {
+	parts := []string{opts.ModProg, opts.ModProtocol}
+
+	args := strings.Fields(opts.ModProg)
+	if len(args) > 0 {
+		p, err := exec.LookPath(args[0])
+		if err == nil {
+			if fi, err := os.Stat(p); err == nil {
+				parts = append(parts, p, fmt.Sprint(fi.Size()), fi.ModTime().UTC().Format(time.RFC3339Nano))
+			}
+		}
+	}
+
+	// The JSON protocols also send the platform and build args with every request
+	if opts.ModProtocol == ModProtocolJSON || opts.ModProtocol == ModProtocolPlugin {
+		parts = append(parts, opts.Platform)
+		keys := make([]string, 0, len(opts.BuildArgs))
+		for k := range opts.BuildArgs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			parts = append(parts, k+"="+opts.BuildArgs[k])
+		}
+	}
+
+	for _, p := range opts.ModConfig {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return "", fmt.Errorf("error reading mod config: %w", err)
+		}
+		parts = append(parts, digest.FromBytes(data).String())
+	}
+
+	return strings.Join(parts, "\x00"), nil
+}
+
+func (c *modCache) path(s Source) string {
+	parts := []string{c.identity, s.Type, s.Ref, s.Name}
+	if c.sourceContext {
+		parts = append(parts, strings.Join(s.Targets, ","), strings.Join(s.Stages, ","), strings.Join(s.Uses, ","))
+	}
+	key := strings.Join(parts, "\x00")
+	return filepath.Join(c.dir, digest.FromString(key).Encoded()+".json")
+}
+
+// Get sets the replacement on the source from the cache.
+// Returns false if there is no entry or it has expired.
+func (c *modCache) Get(s *Source) bool {
+	data, err := os.ReadFile(c.path(*s))
+	if err != nil {
+		return false
+	}
+
+	var cached cachedReplacement
+	if err := json.Unmarshal(data, &cached); err != nil {
+		c.log.Debug("error parsing cached replacement for", s.Ref+":", err)
+		return false
+	}
+	if c.ttl > 0 && time.Since(cached.Created) > c.ttl {
+		return false
+	}
+
+	s.Replace = cached.Replace
+	s.Reason = cached.Reason
+	s.Metadata = cached.Metadata
+	return true
+}
+
+// Put stores the replacement for the source in the cache.
+// Errors are only logged since the cache is an optimization.
+func (c *modCache) Put(s Source) {
+	data, err := json.Marshal(cachedReplacement{
+		Replace:  s.Replace,
+		Reason:   s.Reason,
+		Metadata: s.Metadata,
+		Created:  time.Now(),
+	})
+	if err != nil {
+		c.log.Debug("error caching replacement for", s.Ref+":", err)
+		return
+	}
+
+	// Write to a temp file first so concurrent runs never see a partial entry
+	f, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		c.log.Debug("error caching replacement for", s.Ref+":", err)
+		return
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(s))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		c.log.Debug("error caching replacement for", s.Ref+":", err)
+	}
+}
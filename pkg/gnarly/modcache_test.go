@@ -0,0 +1,133 @@
+package gnarly
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateModCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	modConfig := filepath.Join(dir, "config.json")
+	opts := Options{
+		ModProg: writeModProg(t, `
+echo "$1" >> `+calls+`
+echo "mcr.microsoft.com/$1"
+`),
+		ModConfig:   []string{modConfig},
+		ModCacheTTL: time.Hour,
+	}
+	writeConfig := func(t *testing.T, data string) {
+		t.Helper()
+		if err := os.WriteFile(modConfig, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(t, `{}`)
+
+	dockerfile := []byte(`
+FROM golang:1.18 AS build
+FROM alpine:3.16
+`)
+
+	generate := func(t *testing.T, opts Options, expectedCalls int) {
+		t.Helper()
+		os.Remove(calls)
+
+		result, err := Generate(context.Background(), dockerfile, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range result.Sources {
+			if s.Replace != "mcr.microsoft.com/"+s.Ref {
+				t.Errorf("unexpected replacement for %s: %s", s.Ref, s.Replace)
+			}
+		}
+
+		data, _ := os.ReadFile(calls)
+		if n := len(strings.Fields(string(data))); n != expectedCalls {
+			t.Errorf("expected %d calls to mod-prog, got %d", expectedCalls, n)
+		}
+	}
+
+	generate(t, opts, 2)
+	t.Run("cached", func(t *testing.T) {
+		generate(t, opts, 0)
+	})
+
+	t.Run("no cache", func(t *testing.T) {
+		opts := opts
+		opts.NoModCache = true
+		generate(t, opts, 2)
+	})
+
+	t.Run("config changed", func(t *testing.T) {
+		writeConfig(t, `{"changed": true}`)
+		generate(t, opts, 2)
+		generate(t, opts, 0)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		opts := opts
+		opts.ModCacheTTL = time.Nanosecond
+		time.Sleep(time.Millisecond)
+		generate(t, opts, 2)
+	})
+}
+
+func TestGenerateModCacheJSON(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	calls := filepath.Join(t.TempDir(), "calls")
+	opts := Options{
+		ModProg: writeModProg(t, `
+cat > /dev/null
+echo call >> `+calls+`
+echo '{"version": 1, "sources": []}'
+`),
+		ModProtocol: ModProtocolJSON,
+		ModCacheTTL: time.Hour,
+		Platform:    "linux/amd64",
+		BuildArgs:   map[string]string{"A": "1"},
+	}
+
+	generate := func(t *testing.T, dockerfile string, opts Options, expectedCalls int) {
+		t.Helper()
+		os.Remove(calls)
+
+		if _, err := Generate(context.Background(), []byte(dockerfile), opts); err != nil {
+			t.Fatal(err)
+		}
+
+		data, _ := os.ReadFile(calls)
+		if n := len(strings.Fields(string(data))); n != expectedCalls {
+			t.Errorf("expected %d calls to mod-prog, got %d", expectedCalls, n)
+		}
+	}
+
+	dockerfile := "FROM golang:1.18 AS build\n"
+	generate(t, dockerfile, opts, 1)
+	generate(t, dockerfile, opts, 0)
+
+	t.Run("platform changed", func(t *testing.T) {
+		opts := opts
+		opts.Platform = "linux/arm64"
+		generate(t, dockerfile, opts, 1)
+	})
+
+	t.Run("build args changed", func(t *testing.T) {
+		opts := opts
+		opts.BuildArgs = map[string]string{"A": "2"}
+		generate(t, dockerfile, opts, 1)
+	})
+
+	t.Run("stage changed", func(t *testing.T) {
+		generate(t, "FROM golang:1.18 AS other\n", opts, 1)
+	})
+}
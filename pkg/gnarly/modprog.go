@@ -0,0 +1,458 @@
+package gnarly
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocols for communicating with the mod-prog.
+const (
+	// The mod-prog is executed once per source with the ref as the last argument and prints the replacement to stdout.
+	ModProtocolArgs = "args"
+	// The mod-prog is executed once with a JSON request for all sources on stdin and prints a JSON response to stdout.
+	ModProtocolJSON = "json"
+	// The mod-prog is started once and kept running, a JSON request for each source is written to stdin as a single line and it responds with a single line of JSON on stdout.
+	ModProtocolPlugin = "plugin"
+)
+
+// DefaultModTimeout is how long to wait on a mod-prog plugin to respond to a request or to exit.
+const DefaultModTimeout = 30 * time.Second
+
+// Policies for handling mod-prog failures.
+const (
+	// Return the error from Generate
+	ModOnErrorFail = "fail"
+	// Leave the failed sources without a replacement
+	ModOnErrorSkip = "skip"
+	// Use the builtin matchers from the mod config for the failed sources
+	ModOnErrorBuiltin = "builtin"
+)
+
+// ModProgError is returned when the mod-prog fails to provide a replacement.
+type ModProgError struct {
+	// Ref is the ref the replacement was requested for, this is empty when the request was for all sources.
+	Ref string
+	// ExitCode is the exit code of the mod-prog, or -1 if it did not exit (e.g. it timed out or printed an invalid response).
+	ExitCode int
+	// Stderr is the output captured from the mod-prog
+	Stderr string
+	Err    error
+}
+
+func (e *ModProgError) Error() string {
+	sb := &strings.Builder{}
+	sb.WriteString("mod-prog failed")
+	if e.Ref != "" {
+		sb.WriteString(" for " + e.Ref)
+	}
+	if e.ExitCode >= 0 {
+		sb.WriteString(fmt.Sprintf(" with exit code %d", e.ExitCode))
+	}
+	// The exit code already says everything an exec.ExitError would
+	var exitErr *exec.ExitError
+	if !errors.As(e.Err, &exitErr) {
+		sb.WriteString(": " + e.Err.Error())
+	}
+	if e.Stderr != "" {
+		sb.WriteString(": " + e.Stderr)
+	}
+	return sb.String()
+}
+
+func (e *ModProgError) Unwrap() error {
+	return e.Err
+}
+
+func newModProgError(ref, stderr string, err error) *ModProgError {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	return &ModProgError{Ref: ref, ExitCode: exitCode, Stderr: strings.TrimSpace(stderr), Err: err}
+}
+
+// modProtocolVersion is the version of the JSON protocol.
+// This must be bumped for any incompatible change to modRequest or modResponse.
+const modProtocolVersion = 1
+
+// modRequest is sent to the mod-prog on stdin when using the JSON protocol.
+type modRequest struct {
+	Version int `json:"version"`
+	// Platform is the target platform of the build, e.g. `linux/amd64`
+	Platform  string            `json:"platform"`
+	BuildArgs map[string]string `json:"buildArgs,omitempty"`
+	Sources   []modSource       `json:"sources"`
+}
+
+type modSource struct {
+	Type    string   `json:"type"`
+	Ref     string   `json:"ref"`
+	Name    string   `json:"name,omitempty"`
+	Targets []string `json:"targets,omitempty"`
+	Stages  []string `json:"stages,omitempty"`
+	Uses    []string `json:"uses,omitempty"`
+}
+
+func newModSource(s Source) modSource {
+	return modSource{
+		Type:    s.Type,
+		Ref:     s.Ref,
+		Name:    s.Name,
+		Targets: s.Targets,
+		Stages:  s.Stages,
+		Uses:    s.Uses,
+	}
+}
+
+// modResponse is read from the mod-prog stdout when using the JSON protocol.
+// Sources which are not in the response are not replaced.
+type modResponse struct {
+	Version int                 `json:"version"`
+	Sources []modSourceResponse `json:"sources"`
+}
+
+type modSourceResponse struct {
+	Type    string          `json:"type,omitempty"`
+	Ref     string          `json:"ref,omitempty"`
+	Name    string          `json:"name,omitempty"`
+	Replace string          `json:"replace,omitempty"`
+	Reason  string          `json:"reason,omitempty"`
+	Meta    json.RawMessage `json:"metadata,omitempty"`
+}
+
+// modProgCommand creates the command for the mod-prog with any extra args appended.
+func (o *Options) modProgCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmdWithArgs := append(strings.Fields(o.ModProg), args...)
+	cmd := exec.CommandContext(ctx, cmdWithArgs[0], cmdWithArgs[1:]...)
+	cmd.Env = os.Environ()
+	if len(o.ModConfig) > 0 {
+		cmd.Env = append(cmd.Env, "MOD_CONFIG="+strings.Join(o.ModConfig, string(os.PathListSeparator)))
+	}
+	return cmd
+}
+
+// replaceArgs runs the mod-prog with the ref as the last argument and returns the replacement it prints.
+func (o *Options) replaceArgs(ctx context.Context, typ, ref string) (string, error) {
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	cmd := o.modProgCommand(ctx, ref)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = append(cmd.Env, "MOD_SOURCE_TYPE="+typ)
+	if err := cmd.Run(); err != nil {
+		return "", newModProgError(ref, stderr.String(), err)
+	}
+
+	if stderr.Len() > 0 {
+		io.Copy(o.Stderr, stderr)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// replaceJSON sends all the sources to the mod-prog in a single request and sets the replacements from the response.
+func (o *Options) replaceJSON(ctx context.Context, sources []Source) error {
+	req := modRequest{
+		Version:   modProtocolVersion,
+		Platform:  o.Platform,
+		BuildArgs: o.BuildArgs,
+		Sources:   make([]modSource, 0, len(sources)),
+	}
+	for _, s := range sources {
+		req.Sources = append(req.Sources, newModSource(s))
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	cmd := o.modProgCommand(ctx)
+	cmd.Env = append(cmd.Env, "MOD_PROTOCOL="+ModProtocolJSON)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return newModProgError("", stderr.String(), err)
+	}
+	if stderr.Len() > 0 {
+		io.Copy(o.Stderr, stderr)
+	}
+
+	var resp modResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return newModProgError("", "", fmt.Errorf("error parsing response: %w", err))
+	}
+	if resp.Version != modProtocolVersion {
+		return newModProgError("", "", fmt.Errorf("unsupported protocol version %d, expected %d", resp.Version, modProtocolVersion))
+	}
+
+	for _, r := range resp.Sources {
+		var found bool
+		for i, s := range sources {
+			if s.Type == r.Type && s.Ref == r.Ref && s.Name == r.Name {
+				sources[i].Replace = r.Replace
+				sources[i].Reason = r.Reason
+				sources[i].Metadata = r.Meta
+				found = true
+			}
+		}
+		if !found {
+			o.Logger.Debug("mod-prog returned unknown source", r.Type, r.Ref, r.Name)
+		}
+	}
+	return nil
+}
+
+// buildPlatform gets the target platform of the build, this is the default platform unless it is overridden by a build arg.
+func buildPlatform(buildArgs map[string]string) string {
+	if p := buildArgs["TARGETPLATFORM"]; p != "" {
+		return p
+	}
+	return platformArgs()["TARGETPLATFORM"]
+}
+
+// modPlugin is a long running mod-prog which handles requests for one source at a time.
+type modPlugin struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stderr  *lockedBuffer
+	timeout time.Duration
+
+	// responses gets each line read from stdout by a single reader.
+	// done is closed by Close to stop the reader if nothing is left to receive a line.
+	// readDone is closed once the reader has stopped, readErr is set before it is closed.
+	// The process is only waited on after that, since waiting closes stdout.
+	responses chan []byte
+	done      chan struct{}
+	readDone  chan struct{}
+	readErr   error
+
+	// exited is closed when the process exits, waitErr is set before it is closed.
+	exited  chan struct{}
+	waitErr error
+
+	// dead is set once a request has timed out or been cancelled, the plugin is killed so no further requests are sent.
+	dead error
+}
+
+// lockedBuffer is a bytes.Buffer which is safe to write to from the goroutine exec uses to copy stderr.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.TrimSpace(b.buf.String())
+}
+
+func (o *Options) startModPlugin(ctx context.Context) (*modPlugin, error) {
+	cmd := o.modProgCommand(ctx)
+	cmd.Env = append(cmd.Env, "MOD_PROTOCOL="+ModProtocolPlugin)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &modPlugin{
+		cmd:       cmd,
+		stdin:     stdin,
+		stderr:    &lockedBuffer{},
+		timeout:   o.ModTimeout,
+		responses: make(chan []byte),
+		done:      make(chan struct{}),
+		readDone:  make(chan struct{}),
+		exited:    make(chan struct{}),
+	}
+	// Plugin output is passed through as it happens, but is also kept in case the plugin crashes.
+	cmd.Stderr = io.MultiWriter(o.Stderr, p.stderr)
+
+	if err := cmd.Start(); err != nil {
+		return nil, newModProgError("", "", fmt.Errorf("error starting: %w", err))
+	}
+	go p.read(bufio.NewReader(stdout))
+	go func() {
+		<-p.readDone
+		p.waitErr = cmd.Wait()
+		close(p.exited)
+	}()
+
+	return p, nil
+}
+
+// read sends each line the plugin writes to stdout to the responses channel until reading fails.
+func (p *modPlugin) read(r *bufio.Reader) {
+	defer close(p.readDone)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			p.readErr = err
+			return
+		}
+		select {
+		case p.responses <- line:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// waitExit waits for the plugin to exit after a request failed, discarding anything else it writes to stdout so the reader can stop.
+// Returns false if it does not exit within the timeout.
+func (p *modPlugin) waitExit() bool {
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.exited:
+			return true
+		case <-p.responses:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// exitError gets an error describing why the plugin exited.
+// This must only be called after the plugin has exited.
+func (p *modPlugin) exitError(ref string) error {
+	err := p.waitErr
+	if err == nil {
+		err = errors.New("exited unexpectedly")
+	}
+	return &ModProgError{Ref: ref, ExitCode: p.cmd.ProcessState.ExitCode(), Stderr: p.stderr.String(), Err: err}
+}
+
+// Replace sends the source to the plugin and waits for the response.
+// The plugin is killed if it does not respond within the timeout, since there is no way to know if a late response is for the request that timed out.
+func (p *modPlugin) Replace(ctx context.Context, s Source) (modSourceResponse, error) {
+	data, err := json.Marshal(newModSource(s))
+	if err != nil {
+		return modSourceResponse{}, err
+	}
+
+	if p.dead != nil {
+		return modSourceResponse{}, newModProgError(s.Ref, "", p.dead)
+	}
+
+	select {
+	case <-p.exited:
+		return modSourceResponse{}, p.exitError(s.Ref)
+	default:
+	}
+
+	if _, err := p.stdin.Write(append(data, '\n')); err != nil {
+		// Writes fail when the plugin has exited, give the wait goroutine a chance to report why.
+		if p.waitExit() {
+			return modSourceResponse{}, p.exitError(s.Ref)
+		}
+		return modSourceResponse{}, newModProgError(s.Ref, p.stderr.String(), fmt.Errorf("error writing request: %w", err))
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.readDone:
+		// Reads fail with EOF when the plugin exits.
+		if p.waitExit() {
+			return modSourceResponse{}, p.exitError(s.Ref)
+		}
+		return modSourceResponse{}, newModProgError(s.Ref, p.stderr.String(), fmt.Errorf("error reading response: %w", p.readErr))
+	case line := <-p.responses:
+		var resp modSourceResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return modSourceResponse{}, newModProgError(s.Ref, "", fmt.Errorf("error parsing response: %w", err))
+		}
+		return resp, nil
+	case <-timer.C:
+		p.cmd.Process.Kill()
+		p.dead = fmt.Errorf("plugin was killed after a request timed out after %s", p.timeout)
+		return modSourceResponse{}, newModProgError(s.Ref, p.stderr.String(), fmt.Errorf("timed out after %s waiting for response", p.timeout))
+	case <-ctx.Done():
+		p.cmd.Process.Kill()
+		p.dead = fmt.Errorf("plugin was killed after a request was cancelled: %w", ctx.Err())
+		return modSourceResponse{}, ctx.Err()
+	}
+}
+
+// Close closes stdin to signal the plugin to exit and waits for it to do so.
+// The plugin is killed if it does not exit within the timeout.
+func (p *modPlugin) Close() error {
+	p.stdin.Close()
+	// Nothing reads responses after this, so the reader must not block on sending one
+	close(p.done)
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.exited:
+	case <-timer.C:
+		p.cmd.Process.Kill()
+		<-p.exited
+		return newModProgError("", p.stderr.String(), fmt.Errorf("timed out after %s waiting for exit", p.timeout))
+	}
+
+	if p.waitErr != nil {
+		return newModProgError("", p.stderr.String(), p.waitErr)
+	}
+	return nil
+}
+
+// replacePlugin starts the mod-prog as a plugin and sends a request for each source.
+// Failures are passed to onError along with the sources which failed, processing continues if onError returns nil.
+func (o *Options) replacePlugin(ctx context.Context, sources []Source, onError func(error, []Source) error) error {
+	p, err := o.startModPlugin(ctx)
+	if err != nil {
+		return onError(err, sources)
+	}
+
+	var failed bool
+	for i, s := range sources {
+		resp, err := p.Replace(ctx, s)
+		if err != nil {
+			failed = true
+			if err := onError(err, sources[i:i+1]); err != nil {
+				p.Close()
+				return err
+			}
+			continue
+		}
+		sources[i].Replace = resp.Replace
+		sources[i].Reason = resp.Reason
+		sources[i].Metadata = resp.Meta
+	}
+
+	// Errors on exit have already been reported if any request failed
+	if err := p.Close(); err != nil && !failed {
+		return onError(err, nil)
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package gnarly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeModProg writes a shell script to use as a mod-prog and returns the path to it.
+func writeModProg(t *testing.T, script string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "mod.sh")
+	if err := os.WriteFile(p, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestGenerateJSONProtocol(t *testing.T) {
+	dir := t.TempDir()
+	reqPath := filepath.Join(dir, "request.json")
+	respPath := filepath.Join(dir, "response.json")
+
+	opts := Options{
+		ModProg: writeModProg(t, `
+[ "$MOD_PROTOCOL" = json ] || exit 1
+cat > `+reqPath+`
+cat `+respPath+`
+`),
+		ModProtocol: ModProtocolJSON,
+		NoModCache:  true,
+	}
+
+	dockerfile := []byte(`
+ARG BASE=golang:1.18
+FROM ${BASE} AS build
+FROM alpine:3.16
+COPY --from=build / /
+`)
+
+	writeResponse := func(t *testing.T, resp string) {
+		t.Helper()
+		if err := os.WriteFile(respPath, []byte(resp), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		writeResponse(t, `{
+	"version": 1,
+	"sources": [
+		{"type": "docker-image", "ref": "docker.io/library/golang:1.18", "replace": "mcr.microsoft.com/oss/go/microsoft/golang:1.18", "reason": "mirrored", "metadata": {"owner":"go"}},
+		{"type": "docker-image", "ref": "docker.io/library/unknown:latest", "replace": "foo"}
+	]
+}`)
+
+		opts := opts
+		opts.BuildArgs = map[string]string{"TARGETPLATFORM": "linux/arm64"}
+		result, err := Generate(context.Background(), dockerfile, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []Source{
+			{Type: "docker-image", Ref: "docker.io/library/alpine:3.16", Targets: []string{"stage-1"}, Stages: []string{"stage-1"}, Uses: []string{"from"}},
+			{Type: "docker-image", Ref: "docker.io/library/golang:1.18", Replace: "mcr.microsoft.com/oss/go/microsoft/golang:1.18", Targets: []string{"build", "stage-1"}, Stages: []string{"build"}, Uses: []string{"from"}, Reason: "mirrored", Metadata: json.RawMessage(`{"owner":"go"}`)},
+		}
+		if !reflect.DeepEqual(result.Sources, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+		}
+
+		data, err := os.ReadFile(reqPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req modRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			t.Fatal(err)
+		}
+		expectedReq := modRequest{
+			Version:   modProtocolVersion,
+			Platform:  "linux/arm64",
+			BuildArgs: map[string]string{"TARGETPLATFORM": "linux/arm64"},
+			Sources: []modSource{
+				{Type: "docker-image", Ref: "docker.io/library/alpine:3.16", Targets: []string{"stage-1"}, Stages: []string{"stage-1"}, Uses: []string{"from"}},
+				{Type: "docker-image", Ref: "docker.io/library/golang:1.18", Targets: []string{"build", "stage-1"}, Stages: []string{"build"}, Uses: []string{"from"}},
+			},
+		}
+		if !reflect.DeepEqual(req, expectedReq) {
+			t.Fatalf("expected request %+v, got %+v", expectedReq, req)
+		}
+	})
+
+	t.Run("version mismatch", func(t *testing.T) {
+		writeResponse(t, `{"version": 2, "sources": []}`)
+		if _, err := Generate(context.Background(), dockerfile, opts); err == nil {
+			t.Fatal("expected error for unsupported version")
+		}
+	})
+
+	t.Run("invalid response", func(t *testing.T) {
+		writeResponse(t, `alpine:3.17`)
+		if _, err := Generate(context.Background(), dockerfile, opts); err == nil {
+			t.Fatal("expected error for invalid response")
+		}
+	})
+}
+
+func TestGeneratePluginProtocol(t *testing.T) {
+	opts := Options{
+		ModProtocol: ModProtocolPlugin,
+		ModTimeout:  5 * time.Second,
+		NoModCache:  true,
+	}
+
+	dockerfile := []byte(`
+FROM golang:1.18 AS build
+FROM alpine:3.16
+COPY --from=build / /
+`)
+
+	t.Run("replace", func(t *testing.T) {
+		starts := filepath.Join(t.TempDir(), "starts")
+		opts := opts
+		opts.ModProg = writeModProg(t, `
+[ "$MOD_PROTOCOL" = plugin ] || exit 1
+echo started >> `+starts+`
+while read -r line; do
+	case "$line" in
+		*golang*) echo '{"replace": "mcr.microsoft.com/oss/go/microsoft/golang:1.18", "reason": "mirrored"}' ;;
+		*) echo '{}' ;;
+	esac
+done
+`)
+
+		result, err := Generate(context.Background(), dockerfile, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []Source{
+			{Type: "docker-image", Ref: "docker.io/library/alpine:3.16", Targets: []string{"stage-1"}, Stages: []string{"stage-1"}, Uses: []string{"from"}},
+			{Type: "docker-image", Ref: "docker.io/library/golang:1.18", Replace: "mcr.microsoft.com/oss/go/microsoft/golang:1.18", Targets: []string{"build", "stage-1"}, Stages: []string{"build"}, Uses: []string{"from"}, Reason: "mirrored"},
+		}
+		if !reflect.DeepEqual(result.Sources, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+		}
+
+		data, err := os.ReadFile(starts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "started\n" {
+			t.Errorf("expected plugin to be started once, got %q", data)
+		}
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		opts := opts
+		opts.ModProg = writeModProg(t, `
+read -r line
+echo boom >&2
+exit 3
+`)
+		_, err := Generate(context.Background(), dockerfile, opts)
+		if err == nil {
+			t.Fatal("expected error when plugin crashes")
+		}
+		if !strings.Contains(err.Error(), "boom") {
+			t.Errorf("expected error to include plugin stderr, got: %v", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		opts := opts
+		opts.ModTimeout = 100 * time.Millisecond
+		opts.ModProg = writeModProg(t, `
+read -r line
+exec sleep 10
+`)
+		start := time.Now()
+		if _, err := Generate(context.Background(), dockerfile, opts); err == nil {
+			t.Fatal("expected error when plugin does not respond")
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("expected plugin to be killed after timeout, took %s", d)
+		}
+	})
+
+	t.Run("exit without reading", func(t *testing.T) {
+		opts := opts
+		opts.ModProg = writeModProg(t, `
+echo boom >&2
+exit 3
+`)
+		start := time.Now()
+		if _, err := Generate(context.Background(), dockerfile, opts); err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("expected error to include plugin stderr, got: %v", err)
+		}
+		if d := time.Since(start); d >= opts.ModTimeout {
+			t.Errorf("expected exit to be reported before the timeout, took %s", d)
+		}
+	})
+
+	t.Run("output on exit", func(t *testing.T) {
+		opts := opts
+		// Output after the last request is never read, it must not stop the plugin from being waited on
+		opts.ModProg = writeModProg(t, `
+while read -r line; do
+	echo '{}'
+done
+echo goodbye
+`)
+		if _, err := Generate(context.Background(), dockerfile, opts); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("timeout skip", func(t *testing.T) {
+		opts := opts
+		opts.ModTimeout = 100 * time.Millisecond
+		opts.ModOnError = ModOnErrorSkip
+		// The late response to the first request must not be used for the second
+		opts.ModProg = writeModProg(t, `
+while read -r line; do
+	sleep 0.2
+	echo '{"replace": "late"}'
+done
+`)
+		result, err := Generate(context.Background(), dockerfile, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range result.Sources {
+			if s.Replace != "" {
+				t.Errorf("expected %s not to be replaced, got %s", s.Ref, s.Replace)
+			}
+		}
+	})
+}
+
+func TestGenerateModProgError(t *testing.T) {
+	// Failures are never cached, so the cache only needs to be kept out of the user's cache dir
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	modConfig := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(modConfig, []byte(`[{"match": "^docker.io/library/(.*)$", "replace": "mcr.microsoft.com/$1"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		ModProg: writeModProg(t, `
+echo "no replacement for $1" >&2
+exit 4
+`),
+		ModConfig: []string{modConfig},
+	}
+
+	dockerfile := []byte(`FROM golang:1.18`)
+
+	t.Run("fail", func(t *testing.T) {
+		_, err := Generate(context.Background(), dockerfile, opts)
+		var modErr *ModProgError
+		if !errors.As(err, &modErr) {
+			t.Fatalf("expected ModProgError, got: %v", err)
+		}
+		if modErr.Ref != "docker.io/library/golang:1.18" {
+			t.Errorf("unexpected ref: %s", modErr.Ref)
+		}
+		if modErr.ExitCode != 4 {
+			t.Errorf("unexpected exit code: %d", modErr.ExitCode)
+		}
+		if modErr.Stderr != "no replacement for docker.io/library/golang:1.18" {
+			t.Errorf("unexpected stderr: %s", modErr.Stderr)
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		opts := opts
+		opts.ModOnError = ModOnErrorSkip
+		result, err := Generate(context.Background(), dockerfile, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Sources) != 1 || result.Sources[0].Replace != "" {
+			t.Fatalf("expected source without a replacement, got %+v", result.Sources)
+		}
+	})
+
+	t.Run("builtin", func(t *testing.T) {
+		opts := opts
+		opts.ModOnError = ModOnErrorBuiltin
+		for _, protocol := range []string{ModProtocolArgs, ModProtocolJSON, ModProtocolPlugin} {
+			opts.ModProtocol = protocol
+			result, err := Generate(context.Background(), dockerfile, opts)
+			if err != nil {
+				t.Fatal(protocol, err)
+			}
+			if len(result.Sources) != 1 || result.Sources[0].Replace != "mcr.microsoft.com/golang:1.18" {
+				t.Fatalf("%s: expected builtin replacement, got %+v", protocol, result.Sources)
+			}
+		}
+	})
+}
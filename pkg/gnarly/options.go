@@ -0,0 +1,137 @@
+package gnarly
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+)
+
+// Options configures Generate.
+// The zero value finds all the sources in the Dockerfile without resolving any replacements.
+type Options struct {
+	// BuildArgs are the build args passed to the build, these are required if the Dockerfile uses args to determine a source
+	BuildArgs map[string]string
+	// Target is the build target to find sources for, sources for all targets are returned if it is empty
+	Target string
+	// BuildContexts are the named contexts passed to the build (`--build-context`).
+	// Sources provided by a named context are reported with the context name and type instead of the image they replace.
+	BuildContexts map[string]string
+	// Platform is the target platform of the build, e.g. `linux/amd64`.
+	// Defaults to the TARGETPLATFORM build arg, or the default platform if that is not set.
+	Platform string
+
+	// ModProg is the program (with any args) which is run to get replacements.
+	// The builtin matcher is used with the rules from ModConfig and Rules if it is empty.
+	ModProg string
+	// ModProtocol is how to talk to the mod-prog, defaults to ModProtocolArgs
+	ModProtocol string
+	// ModTimeout is how long to wait on a mod-prog plugin, defaults to DefaultModTimeout
+	ModTimeout time.Duration
+	// ModOnError is what to do when the mod-prog fails, defaults to ModOnErrorFail
+	ModOnError string
+	// ModConfig are the paths to the mod configs, from lowest to highest precedence.
+	// They are passed to the mod-prog in the MOD_CONFIG env var.
+	ModConfig []string
+	// ModTable are the paths to lookup tables of refs to their replacements, from lowest to highest precedence.
+	// These are checked before the mod-prog, Replacer or builtin matcher. Mod configs which are lookup tables are also detected when using the builtin matcher.
+	ModTable []string
+	// Rules are rules for the builtin matcher, these take precedence over rules from ModConfig
+	Rules []Rule
+	// MaxRulePasses limits the passes over the rules for a single ref when rules are chained, defaults to DefaultMaxRulePasses
+	MaxRulePasses int
+	// Replacer resolves replacements instead of the mod-prog or the builtin matcher, replacements from it are not cached
+	Replacer Replacer
+	// Policy is how allow and deny rules are applied, defaults to PolicyEnforce.
+	// Policy rules are only read from ModConfig when using a mod-prog or Replacer if this is set.
+	Policy string
+
+	// Jobs is the number of sources to resolve replacements (and pins) for in parallel, defaults to the number of CPUs
+	Jobs int
+	// NoModCache disables caching replacements from the mod-prog on disk
+	NoModCache bool
+	// ModCacheTTL is how long replacements from the mod-prog are cached for, defaults to DefaultModCacheTTL.
+	// Cached replacements never expire if it is negative.
+	ModCacheTTL time.Duration
+
+	// Pin resolves sources to pinned digests, either PinReplace or PinAll
+	Pin string
+	// ResolveConfig fetches real image configs from the registry to analyze stages which depend on them (e.g. ONBUILD triggers)
+	ResolveConfig bool
+
+	// Logger receives debug output and warnings, nothing is logged if it is nil
+	Logger Logger
+	// Stderr receives the stderr of the mod-prog, it is discarded if this is nil
+	Stderr io.Writer
+}
+
+// Logger receives debug output and warnings.
+// The arguments are the same as for fmt.Println, a logrus.FieldLogger can also be used.
+type Logger interface {
+	Debug(args ...interface{})
+	Warn(args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(args ...interface{}) {}
+func (nopLogger) Warn(args ...interface{})  {}
+
+// withDefaults fills in the defaults for any options which are not set.
+func (o Options) withDefaults() Options {
+	if o.Platform == "" {
+		o.Platform = buildPlatform(o.BuildArgs)
+	}
+	if o.ModProtocol == "" {
+		o.ModProtocol = ModProtocolArgs
+	}
+	if o.ModTimeout <= 0 {
+		o.ModTimeout = DefaultModTimeout
+	}
+	if o.ModOnError == "" {
+		o.ModOnError = ModOnErrorFail
+	}
+	if o.MaxRulePasses <= 0 {
+		o.MaxRulePasses = DefaultMaxRulePasses
+	}
+	if o.Jobs <= 0 {
+		o.Jobs = runtime.NumCPU()
+	}
+	if o.ModCacheTTL == 0 {
+		o.ModCacheTTL = DefaultModCacheTTL
+	}
+	if o.Logger == nil {
+		o.Logger = nopLogger{}
+	}
+	if o.Stderr == nil {
+		o.Stderr = io.Discard
+	}
+	return o
+}
+
+func (o *Options) validate() error {
+	switch o.Pin {
+	case "", PinReplace, PinAll:
+	default:
+		return fmt.Errorf("unknown pin mode: %s", o.Pin)
+	}
+
+	switch o.ModProtocol {
+	case "", ModProtocolArgs, ModProtocolJSON, ModProtocolPlugin:
+	default:
+		return fmt.Errorf("unknown mod protocol: %s", o.ModProtocol)
+	}
+
+	switch o.ModOnError {
+	case "", ModOnErrorFail, ModOnErrorSkip, ModOnErrorBuiltin:
+	default:
+		return fmt.Errorf("unknown mod-prog error policy: %s", o.ModOnError)
+	}
+
+	switch o.Policy {
+	case "", PolicyEnforce, PolicyWarn, PolicyOff:
+	default:
+		return fmt.Errorf("unknown policy mode: %s", o.Policy)
+	}
+	return nil
+}
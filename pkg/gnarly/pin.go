@@ -0,0 +1,77 @@
+package gnarly
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+)
+
+// Modes for pinning sources to a digest.
+const (
+	// Only pin replacements
+	PinReplace = "replace"
+	// Pin replacements and set a pinned replacement for any ref that does not have one
+	PinAll = "all"
+)
+
+// pinner resolves image refs to digests using the registry API.
+// It is safe for concurrent use.
+type pinner struct {
+	resolver remotes.Resolver
+	log      Logger
+
+	mu     sync.Mutex
+	pinned map[string]string
+}
+
+func newPinner(log Logger) (*pinner, error) {
+	resolver, err := newRegistryResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	return &pinner{
+		resolver: resolver,
+		log:      log,
+		pinned:   make(map[string]string),
+	}, nil
+}
+
+// Pin resolves the ref against the registry and returns it in the form of `name:tag@digest`.
+// Refs which already have a digest are returned as is.
+func (p *pinner) Pin(ctx context.Context, ref string) (string, error) {
+	p.mu.Lock()
+	v, ok := p.pinned[ref]
+	p.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", fmt.Errorf("error parsing ref %s: %w", ref, err)
+	}
+	if _, ok := named.(reference.Canonical); ok {
+		return ref, nil
+	}
+
+	tagged := reference.TagNameOnly(named).(reference.NamedTagged)
+	_, desc, err := p.resolver.Resolve(withRegistryLogger(ctx, p.log), tagged.String())
+	if err != nil {
+		return "", fmt.Errorf("error resolving digest for %s: %w", ref, err)
+	}
+
+	withDigest, err := reference.WithDigest(tagged, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	p.log.Debug("pinned", ref, "to", withDigest.String())
+	p.mu.Lock()
+	p.pinned[ref] = withDigest.String()
+	p.mu.Unlock()
+	return withDigest.String(), nil
+}
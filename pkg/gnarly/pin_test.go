@@ -0,0 +1,193 @@
+package gnarly
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// newTestRegistry creates a registry stand-in which requires basic auth and serves manifests for the passed in `<repo>:<tag>` refs.
+// Manifests can also be fetched by digest, and any extra blobs are served by digest for all repos.
+func newTestRegistry(t *testing.T, user, pass string, manifests map[string]string, blobs ...string) *httptest.Server {
+	t.Helper()
+
+	byDigest := map[digest.Digest]string{}
+	for _, m := range manifests {
+		byDigest[digest.FromString(m)] = m
+	}
+	for _, b := range blobs {
+		byDigest[digest.FromString(b)] = b
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || u != user || p != pass {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path == "/v2/" {
+			return
+		}
+
+		var (
+			content string
+			found   bool
+		)
+		if split := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/", 2); len(split) == 2 {
+			content, found = manifests[split[0]+":"+split[1]]
+			if !found {
+				content, found = byDigest[digest.Digest(split[1])]
+			}
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		} else if split := strings.SplitN(r.URL.Path, "/blobs/", 2); len(split) == 2 {
+			content, found = byDigest[digest.Digest(split[1])]
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Docker-Content-Digest", digest.FromString(content).String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == http.MethodGet {
+			w.Write([]byte(content))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func withDockerConfig(t *testing.T, host, user, pass string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	data, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			host: map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_CONFIG", dir)
+}
+
+func TestPin(t *testing.T) {
+	const manifest = `{"schemaVersion": 2}`
+	dgst := digest.FromString(manifest)
+
+	srv := newTestRegistry(t, "user", "pass", map[string]string{
+		"foo:1.0":    manifest,
+		"foo:latest": manifest,
+	})
+	host := strings.TrimPrefix(srv.URL, "http://")
+	withDockerConfig(t, host, "user", "pass")
+
+	p, err := newPinner(nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for ref, expected := range map[string]string{
+		host + "/foo:1.0":                  host + "/foo:1.0@" + dgst.String(),
+		host + "/foo":                      host + "/foo:latest@" + dgst.String(),
+		host + "/foo:1.0@" + dgst.String(): host + "/foo:1.0@" + dgst.String(),
+	} {
+		pinned, err := p.Pin(ctx, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pinned != expected {
+			t.Errorf("expected %s, got %s", expected, pinned)
+		}
+	}
+
+	if _, err := p.Pin(ctx, host+"/foo:missing"); err == nil {
+		t.Error("expected error for missing tag")
+	}
+
+	t.Run("bad credentials", func(t *testing.T) {
+		withDockerConfig(t, host, "user", "wrong")
+		p, err := newPinner(nopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Pin(ctx, host+"/foo:1.0"); err == nil {
+			t.Error("expected error with bad credentials")
+		}
+	})
+}
+
+func TestGeneratePin(t *testing.T) {
+	const manifest = `{"schemaVersion": 2}`
+	dgst := digest.FromString(manifest)
+
+	srv := newTestRegistry(t, "user", "pass", map[string]string{
+		"bar:1.0": manifest,
+		"foo:2.0": manifest,
+	})
+	host := strings.TrimPrefix(srv.URL, "http://")
+	withDockerConfig(t, host, "user", "pass")
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	config := `[{"match": "docker.io/library/foo:1.0", "replace": "` + host + `/bar:1.0"}]`
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dockerfile := []byte(`
+FROM foo:1.0 AS one
+FROM ` + host + `/foo:2.0 AS two
+`)
+
+	t.Run("replace", func(t *testing.T) {
+		result, err := Generate(context.Background(), dockerfile, Options{ModConfig: []string{configPath}, Pin: PinReplace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []Source{
+			{Type: "docker-image", Ref: host + "/foo:2.0", Targets: []string{"two"}, Stages: []string{"two"}, Uses: []string{"from"}},
+			{Type: "docker-image", Ref: "docker.io/library/foo:1.0", Replace: host + "/bar:1.0@" + dgst.String(), Targets: []string{"one"}, Stages: []string{"one"}, Uses: []string{"from"}},
+		}
+		if !reflect.DeepEqual(result.Sources, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		result, err := Generate(context.Background(), dockerfile, Options{ModConfig: []string{configPath}, Pin: PinAll})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []Source{
+			{Type: "docker-image", Ref: host + "/foo:2.0", Replace: host + "/foo:2.0@" + dgst.String(), Targets: []string{"two"}, Stages: []string{"two"}, Uses: []string{"from"}},
+			{Type: "docker-image", Ref: "docker.io/library/foo:1.0", Replace: host + "/bar:1.0@" + dgst.String(), Targets: []string{"one"}, Stages: []string{"one"}, Uses: []string{"from"}},
+		}
+		if !reflect.DeepEqual(result.Sources, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := Generate(context.Background(), dockerfile, Options{ModConfig: []string{configPath}, Pin: "bogus"}); err == nil {
+			t.Fatal("expected error for unknown pin mode")
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package gnarly
+
+import (
+	"fmt"
+	"strings"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	RuleActionAllow = "allow"
+	RuleActionDeny  = "deny"
+)
+
+const (
+	// PolicyEnforce fails when a source is not allowed
+	PolicyEnforce = "enforce"
+	// PolicyWarn only reports sources which are not allowed
+	PolicyWarn = "warn"
+	// PolicyOff ignores policy rules
+	PolicyOff = "off"
+)
+
+// PolicyViolation is a source which is not allowed by the policy rules in the mod config.
+type PolicyViolation struct {
+	Type   string
+	Ref    string
+	Stages []string
+	// Rule is the deny rule which matched the source, or empty if the source did not match any allow rule
+	Rule string
+}
+
+func (v PolicyViolation) String() string {
+	s := v.Type + " " + v.Ref
+	if len(v.Stages) > 0 {
+		s += " (stages: " + strings.Join(v.Stages, ", ") + ")"
+	}
+	if v.Rule == "" {
+		return s + ": not allowed by any rule"
+	}
+	return s + ": denied by rule " + v.Rule
+}
+
+// PolicyError is returned when sources without a replacement are not allowed by the policy rules in the mod config.
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "%d source(s) not allowed by policy:", len(e.Violations))
+	for _, v := range e.Violations {
+		sb.WriteString("\n\t")
+		sb.WriteString(v.String())
+	}
+	return sb.String()
+}
+
+// Allowed checks the policy rules for the ref.
+// The first policy rule which matches decides, a ref which does not match any rule is only allowed if there are no allow rules for the source type.
+// Returns the deny rule which matched, if any.
+func (s *ruleSet) Allowed(typ, ref string, p ocispecs.Platform) (bool, *Rule) {
+	if s == nil {
+		return true, nil
+	}
+
+	var hasAllow bool
+	for i, rule := range s.policy {
+		if !rule.applies(typ, p) {
+			continue
+		}
+		if rule.Action == RuleActionAllow {
+			hasAllow = true
+		}
+		if !rule.matches(ref) {
+			continue
+		}
+		s.log.Debug("policy rule", rule.String(), rule.Action, typ, ref)
+		if rule.Action == RuleActionDeny {
+			return false, &s.policy[i]
+		}
+		return true, nil
+	}
+	return !hasAllow, nil
+}
+
+// checkPolicy checks sources without a replacement against the policy rules.
+// Sources with a replacement are not checked since the original ref is never used.
+func checkPolicy(rules *ruleSet, sources []Source, opts *Options) error {
+	if opts.Policy == PolicyOff || rules == nil || len(rules.policy) == 0 {
+		return nil
+	}
+
+	p := parsePlatform(opts.Platform, rules.log)
+	var violations []PolicyViolation
+	for _, s := range sources {
+		if s.Replace != "" || s.onbuildOnly() {
+			continue
+		}
+		if ok, rule := rules.Allowed(s.Type, s.Ref, p); !ok {
+			v := PolicyViolation{Type: s.Type, Ref: s.Ref, Stages: s.Stages}
+			if rule != nil {
+				v.Rule = rule.String()
+			}
+			violations = append(violations, v)
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	err := &PolicyError{Violations: violations}
+	if opts.Policy == PolicyWarn {
+		opts.Logger.Warn(err)
+		return nil
+	}
+	return err
+}
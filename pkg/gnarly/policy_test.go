@@ -0,0 +1,87 @@
+package gnarly
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGeneratePolicy(t *testing.T) {
+	modConfig := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(modConfig, []byte(`
+- match: ^docker.io/library/golang:(.*)$
+  replace: mcr.microsoft.com/oss/go/microsoft/golang:$1
+- id: no-latest
+  action: deny
+  ref:
+    tag: latest
+- action: allow
+  ref:
+    domain: mcr.microsoft.com
+- action: allow
+  ref:
+    repo: library/alpine
+    tagRange: ">=3.15"
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dockerfile := []byte(`
+FROM golang:1.18 AS build
+FROM alpine:3.14 AS old
+FROM mcr.microsoft.com/cbl-mariner/base/core:2.0 AS mariner
+FROM alpine:latest
+COPY --from=build / /
+COPY --from=old / /
+COPY --from=mariner / /
+`)
+
+	t.Run("enforce", func(t *testing.T) {
+		_, err := Generate(context.Background(), dockerfile, Options{ModConfig: []string{modConfig}})
+		var policyErr *PolicyError
+		if !errors.As(err, &policyErr) {
+			t.Fatalf("expected PolicyError, got: %v", err)
+		}
+		expected := []PolicyViolation{
+			{Type: "docker-image", Ref: "docker.io/library/alpine:3.14", Stages: []string{"old"}},
+			{Type: "docker-image", Ref: "docker.io/library/alpine:latest", Stages: []string{"stage-3"}, Rule: "no-latest"},
+		}
+		if !reflect.DeepEqual(policyErr.Violations, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, policyErr.Violations)
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		result, err := Generate(context.Background(), dockerfile, Options{ModConfig: []string{modConfig}, Policy: PolicyWarn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Sources) != 4 {
+			t.Fatalf("expected all sources, got %+v", result.Sources)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		if _, err := Generate(context.Background(), dockerfile, Options{ModConfig: []string{modConfig}, Policy: PolicyOff}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("mod prog", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		opts := Options{ModProg: writeModProg(t, `echo`), ModConfig: []string{modConfig}}
+
+		// Policy rules are only read from the config when the mode is set explicitly
+		if _, err := Generate(context.Background(), dockerfile, opts); err != nil {
+			t.Fatal(err)
+		}
+		opts.Policy = PolicyEnforce
+		var policyErr *PolicyError
+		if _, err := Generate(context.Background(), dockerfile, opts); !errors.As(err, &policyErr) {
+			t.Fatalf("expected PolicyError, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package gnarly
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// RefMatch matches the parsed components of an image ref.
+// All fields which are set must match, globs use the same syntax as path.Match.
+type RefMatch struct {
+	// Domain is a glob for the registry domain, e.g. `docker.io`
+	Domain string `json:"domain,omitempty" yaml:"domain,omitempty" toml:"domain,omitempty"`
+	// Repo is a glob for the repository path, e.g. `library/*`
+	Repo string `json:"repo,omitempty" yaml:"repo,omitempty" toml:"repo,omitempty"`
+	// Tag is a glob for the tag, e.g. `1.18*`
+	Tag string `json:"tag,omitempty" yaml:"tag,omitempty" toml:"tag,omitempty"`
+	// TagRange is a semver constraint for the version in the tag, e.g. `>=1.17, <1.19`.
+	// The variant suffix of the tag is not part of the version, so `1.18-bullseye` is in the range `>=1.18`.
+	// Tags which are not versions never match.
+	TagRange string `json:"tagRange,omitempty" yaml:"tagRange,omitempty" toml:"tagRange,omitempty"`
+	// Variant is a glob for the suffix after the version in the tag, e.g. `alpine*`.
+	// An empty glob matches any variant, use `-` to only match tags without a variant.
+	Variant string `json:"variant,omitempty" yaml:"variant,omitempty" toml:"variant,omitempty"`
+	// Digest is a glob for the digest, e.g. `sha256:*`
+	Digest string `json:"digest,omitempty" yaml:"digest,omitempty" toml:"digest,omitempty"`
+
+	tagRange *semver.Constraints
+}
+
+// RefReplace sets components of an image ref.
+// Values can reference the components of the matched ref with `$domain`, `$repo`, `$tag` and `$digest`.
+type RefReplace struct {
+	Domain string `json:"domain,omitempty" yaml:"domain,omitempty" toml:"domain,omitempty"`
+	Repo   string `json:"repo,omitempty" yaml:"repo,omitempty" toml:"repo,omitempty"`
+	Tag    string `json:"tag,omitempty" yaml:"tag,omitempty" toml:"tag,omitempty"`
+	Digest string `json:"digest,omitempty" yaml:"digest,omitempty" toml:"digest,omitempty"`
+	// TagPolicy replaces the tag with one of Tags, after Tag is applied.
+	// The rule does not match if none of Tags fit the policy.
+	TagPolicy string `json:"tagPolicy,omitempty" yaml:"tagPolicy,omitempty" toml:"tagPolicy,omitempty"`
+	// Tags are the tags available to TagPolicy, e.g. the tags in a mirror
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty" toml:"tags,omitempty"`
+}
+
+const (
+	// TagPolicyLatestPatch upgrades to the latest tag with the same major and minor version and variant
+	TagPolicyLatestPatch = "latest-patch"
+	// TagPolicyLatestMinor upgrades to the latest tag with the same major version and variant
+	TagPolicyLatestMinor = "latest-minor"
+	// TagPolicyLatest upgrades to the latest tag with the same variant
+	TagPolicyLatest = "latest"
+)
+
+// versionTagRegex matches tags which start with a version, e.g. `1.18`, `v1.17.8` or `1.17.8-alpine3.16`.
+var versionTagRegex = regexp.MustCompile(`^v?(\d+(?:\.\d+){0,2})(?:-(.+))?$`)
+
+// tagVersion is a tag split into its version and variant.
+type tagVersion struct {
+	version *semver.Version
+	variant string
+}
+
+// parseTagVersion parses a tag which starts with a version.
+// Unlike a semver pre-release, the suffix after the version is treated as a variant of the same version (`1.18-bullseye` is 1.18 built on bullseye).
+func parseTagVersion(tag string) (tagVersion, bool) {
+	m := versionTagRegex.FindStringSubmatch(tag)
+	if m == nil {
+		return tagVersion{}, false
+	}
+	v, err := semver.NewVersion(m[1])
+	if err != nil {
+		return tagVersion{}, false
+	}
+	return tagVersion{version: v, variant: m[2]}, true
+}
+
+// refParts are the components of a parsed image ref.
+type refParts struct {
+	Domain string
+	Repo   string
+	Tag    string
+	Digest string
+}
+
+func parseRefParts(ref string) (refParts, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return refParts{}, err
+	}
+
+	p := refParts{
+		Domain: reference.Domain(named),
+		Repo:   reference.Path(named),
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		p.Tag = tagged.Tag()
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		p.Digest = canonical.Digest().String()
+	}
+	return p, nil
+}
+
+func (p refParts) String() (string, error) {
+	named, err := reference.ParseNormalizedNamed(p.Domain + "/" + p.Repo)
+	if err != nil {
+		return "", err
+	}
+	if p.Tag != "" {
+		named, err = reference.WithTag(named, p.Tag)
+		if err != nil {
+			return "", err
+		}
+	}
+	if p.Digest != "" {
+		dgst, err := digest.Parse(p.Digest)
+		if err != nil {
+			return "", err
+		}
+		named, err = reference.WithDigest(named, dgst)
+		if err != nil {
+			return "", err
+		}
+	}
+	return named.String(), nil
+}
+
+// String describes the matcher, e.g. `domain=docker.io repo=library/*`.
+func (m *RefMatch) String() string {
+	var fields []string
+	for _, f := range []struct{ k, v string }{
+		{"domain", m.Domain},
+		{"repo", m.Repo},
+		{"tag", m.Tag},
+		{"tagRange", m.TagRange},
+		{"variant", m.Variant},
+		{"digest", m.Digest},
+	} {
+		if f.v != "" {
+			fields = append(fields, f.k+"="+f.v)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func (m *RefMatch) compile() error {
+	for _, glob := range []string{m.Domain, m.Repo, m.Tag, m.Digest} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+	}
+	if _, err := path.Match(m.Variant, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %w", m.Variant, err)
+	}
+	if m.TagRange != "" {
+		c, err := semver.NewConstraint(m.TagRange)
+		if err != nil {
+			return fmt.Errorf("invalid tag range %q: %w", m.TagRange, err)
+		}
+		m.tagRange = c
+	}
+	return nil
+}
+
+func globMatch(glob, s string) bool {
+	if glob == "" {
+		return true
+	}
+	ok, _ := path.Match(glob, s)
+	return ok
+}
+
+// Match checks if the parsed ref matches.
+func (m *RefMatch) Match(p refParts) bool {
+	if !globMatch(m.Domain, p.Domain) || !globMatch(m.Repo, p.Repo) || !globMatch(m.Tag, p.Tag) || !globMatch(m.Digest, p.Digest) {
+		return false
+	}
+	if m.tagRange == nil && m.Variant == "" {
+		return true
+	}
+
+	tv, ok := parseTagVersion(p.Tag)
+	if !ok {
+		return false
+	}
+	if m.tagRange != nil && !m.tagRange.Check(tv.version) {
+		return false
+	}
+	switch m.Variant {
+	case "":
+		return true
+	case "-":
+		return tv.variant == ""
+	default:
+		return globMatch(m.Variant, tv.variant)
+	}
+}
+
+func (r RefReplace) compile() error {
+	switch r.TagPolicy {
+	case "", TagPolicyLatestPatch, TagPolicyLatestMinor, TagPolicyLatest:
+	default:
+		return fmt.Errorf("unknown tag policy: %s", r.TagPolicy)
+	}
+	if r.TagPolicy != "" && len(r.Tags) == 0 {
+		return fmt.Errorf("tag policy %s requires a list of tags", r.TagPolicy)
+	}
+	return nil
+}
+
+// selectTag picks the latest of the available tags which fits the policy for the tag.
+// Returns false if the tag is not a version or no tag fits.
+func selectTag(policy, tag string, available []string) (string, bool) {
+	cur, ok := parseTagVersion(tag)
+	if !ok {
+		return "", false
+	}
+
+	var (
+		best    string
+		bestVer *semver.Version
+	)
+	for _, t := range available {
+		tv, ok := parseTagVersion(t)
+		if !ok || tv.variant != cur.variant || tv.version.LessThan(cur.version) {
+			continue
+		}
+		switch policy {
+		case TagPolicyLatestPatch:
+			if tv.version.Major() != cur.version.Major() || tv.version.Minor() != cur.version.Minor() {
+				continue
+			}
+		case TagPolicyLatestMinor:
+			if tv.version.Major() != cur.version.Major() {
+				continue
+			}
+		}
+		if bestVer == nil || tv.version.GreaterThan(bestVer) {
+			best, bestVer = t, tv.version
+		}
+	}
+	return best, bestVer != nil
+}
+
+// Apply sets the components of the parsed ref.
+// Changing the domain, repo or tag drops the digest unless a digest is also set since it would no longer be valid.
+// Returns false if the tag policy has no tag for the ref.
+func (r RefReplace) Apply(p refParts) (refParts, bool) {
+	expand := func(s string) string {
+		return os.Expand(s, func(key string) string {
+			switch key {
+			case "domain":
+				return p.Domain
+			case "repo":
+				return p.Repo
+			case "tag":
+				return p.Tag
+			case "digest":
+				return p.Digest
+			}
+			return "$" + key
+		})
+	}
+
+	out := p
+	if r.Domain != "" {
+		out.Domain = expand(r.Domain)
+	}
+	if r.Repo != "" {
+		out.Repo = expand(r.Repo)
+	}
+	if r.Tag != "" {
+		out.Tag = expand(r.Tag)
+	}
+	if r.TagPolicy != "" {
+		tag, ok := selectTag(r.TagPolicy, out.Tag, r.Tags)
+		if !ok {
+			return refParts{}, false
+		}
+		out.Tag = tag
+	}
+	if r.Digest != "" {
+		out.Digest = expand(r.Digest)
+	} else if out.Domain != p.Domain || out.Repo != p.Repo || out.Tag != p.Tag {
+		out.Digest = ""
+	}
+	return out, true
+}
@@ -0,0 +1,55 @@
+package gnarly
+
+import (
+	"context"
+	"io"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/sirupsen/logrus"
+)
+
+// newRegistryResolver creates a resolver for talking to registries using the credentials from the docker config.
+// Registries on localhost are accessed over plain HTTP.
+func newRegistryResolver() (remotes.Resolver, error) {
+	cfg, err := loadDockerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	authorizer := docker.NewDockerAuthorizer(docker.WithAuthCreds(cfg.Credentials))
+	hosts := docker.ConfigureDefaultRegistries(
+		docker.WithAuthorizer(authorizer),
+		docker.WithPlainHTTP(docker.MatchLocalhost),
+	)
+	return docker.NewResolver(docker.ResolverOptions{Hosts: hosts}), nil
+}
+
+// withRegistryLogger sets the logger used by the resolver.
+// The resolver logs every registry host it falls through at info level, so everything below warn level is sent to the debug log.
+func withRegistryLogger(ctx context.Context, l Logger) context.Context {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(logrus.DebugLevel)
+	logger.AddHook(loggerHook{l})
+	return log.WithLogger(ctx, logrus.NewEntry(logger))
+}
+
+// loggerHook sends logrus entries to a Logger.
+type loggerHook struct {
+	log Logger
+}
+
+func (h loggerHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h loggerHook) Fire(e *logrus.Entry) error {
+	if e.Level <= logrus.WarnLevel {
+		h.log.Warn(e.Message)
+	} else {
+		h.log.Debug(e.Message)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package gnarly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Replacer resolves replacements for sources.
+type Replacer interface {
+	// Replace sets the replacement (and optionally the reason and metadata) on each of the sources it has a replacement for.
+	// Sources without a replacement are left as they are.
+	Replace(ctx context.Context, sources []Source) error
+}
+
+// ReplacerFunc is a function which can be used as a Replacer.
+type ReplacerFunc func(ctx context.Context, sources []Source) error
+
+func (f ReplacerFunc) Replace(ctx context.Context, sources []Source) error {
+	return f(ctx, sources)
+}
+
+// Chain creates a Replacer which tries each of the replacers in order.
+// Only sources which are still without a replacement are passed to the next replacer, so later replacers act as a fallback for earlier ones.
+func Chain(replacers ...Replacer) Replacer {
+	return chain(replacers)
+}
+
+type chain []Replacer
+
+func (c chain) Replace(ctx context.Context, sources []Source) error {
+	for _, r := range c {
+		var (
+			pending    []Source
+			pendingIdx []int
+		)
+		for i, s := range sources {
+			if s.Replace == "" {
+				pending = append(pending, s)
+				pendingIdx = append(pendingIdx, i)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		if err := r.Replace(ctx, pending); err != nil {
+			return err
+		}
+		for i, s := range pending {
+			sources[pendingIdx[i]] = s
+		}
+	}
+	return nil
+}
+
+// RulesReplacer resolves replacements with the rules of the builtin matcher.
+type RulesReplacer struct {
+	rules *ruleSet
+	// table is checked before the rules
+	table    TableReplacer
+	platform string
+}
+
+// NewRulesReplacer loads the rules from the mod configs and the extra rules in opts.
+// Mod configs which are lookup tables are checked before any rules.
+// Rules only apply to sources for the platform in opts.
+func NewRulesReplacer(opts Options) (*RulesReplacer, error) {
+	opts = opts.withDefaults()
+	rules, table, err := loadRules(opts.ModConfig, opts.Rules)
+	if err != nil {
+		return nil, err
+	}
+	rules.maxPasses = opts.MaxRulePasses
+	rules.log = opts.Logger
+	return &RulesReplacer{rules: rules, table: table, platform: opts.Platform}, nil
+}
+
+func (r *RulesReplacer) Replace(ctx context.Context, sources []Source) error {
+	if err := r.table.Replace(ctx, sources); err != nil {
+		return err
+	}
+	for i, s := range sources {
+		if s.Replace != "" {
+			continue
+		}
+		replace, trials, err := r.rules.Explain(s.Type, s.Ref, r.platform)
+		if err != nil {
+			return err
+		}
+		if e := explanationFor(ctx, s); e != nil && r.rules != nil {
+			e.Resolver = ResolverRules
+			e.addTrials(trials)
+		}
+		sources[i].Replace = replace
+	}
+	return nil
+}
+
+// ProgReplacer resolves replacements by running the mod-prog.
+type ProgReplacer struct {
+	opts Options
+
+	// OnError is called when the mod-prog fails with the error and the sources which it failed for, processing continues if it returns nil.
+	// The error is returned from Replace if this is not set.
+	OnError func(err error, sources []Source) error
+}
+
+// NewProgReplacer creates a Replacer for the mod-prog and protocol in opts.
+// ModOnError is only applied by Generate, use OnError to handle failures.
+func NewProgReplacer(opts Options) (*ProgReplacer, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.ModProg == "" {
+		return nil, fmt.Errorf("no mod-prog set")
+	}
+	return &ProgReplacer{opts: opts}, nil
+}
+
+func (r *ProgReplacer) Replace(ctx context.Context, sources []Source) error {
+	onError := r.OnError
+	if onError == nil {
+		onError = func(err error, _ []Source) error { return err }
+	}
+
+	for _, s := range sources {
+		if e := explanationFor(ctx, s); e != nil {
+			e.Resolver = ResolverModProg
+			e.Program = r.opts.ModProg
+			e.Protocol = r.opts.ModProtocol
+		}
+	}
+
+	switch r.opts.ModProtocol {
+	case ModProtocolJSON:
+		if err := r.opts.replaceJSON(ctx, sources); err != nil {
+			return onError(err, sources)
+		}
+		return nil
+	case ModProtocolPlugin:
+		return r.opts.replacePlugin(ctx, sources, onError)
+	default:
+		return parallel(len(sources), r.opts.Jobs, func(i int) error {
+			s := &sources[i]
+			replace, err := r.opts.replaceArgs(ctx, s.Type, s.Ref)
+			if err != nil {
+				return onError(err, sources[i:i+1])
+			}
+			s.Replace = replace
+			return nil
+		})
+	}
+}
+
+// TableReplacer replaces refs using a static lookup table of refs to their replacements.
+// Use NewTable to create one so that image refs in the table are normalized.
+type TableReplacer map[string]string
+
+// NewTable creates a lookup table from refs to their replacements.
+// Image refs are normalized so that `golang:1.18` matches `docker.io/library/golang:1.18`, an entry which is already normalized takes precedence over one which is not.
+func NewTable(entries map[string]string) TableReplacer {
+	table := make(TableReplacer, len(entries))
+	for ref, replace := range entries {
+		table[ref] = replace
+	}
+	for ref, replace := range entries {
+		normalized, err := normalizeRef(ref)
+		if err != nil {
+			// Not an image ref, e.g. a git or http URL
+			continue
+		}
+		if _, ok := entries[normalized]; !ok {
+			table[normalized] = replace
+		}
+	}
+	return table
+}
+
+// LoadTable reads a lookup table from a JSON (or YAML) file containing an object of refs to their replacements, e.g. `{"golang:1.18": "mcr.microsoft.com/oss/go/microsoft/golang:1.18"}`.
+func LoadTable(p string) (TableReplacer, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading lookup table: %w", err)
+	}
+	table, err := decodeTable(data, filepath.Ext(p))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return table, nil
+}
+
+// isTable checks if a mod config is a lookup table rather than a list of rules.
+func isTable(data []byte, ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".toml":
+		return false
+	case ".yaml", ".yml":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+			return false
+		}
+		return doc.Content[0].Kind == yaml.MappingNode
+	default:
+		return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+	}
+}
+
+func decodeTable(data []byte, ext string) (TableReplacer, error) {
+	var (
+		entries map[string]string
+		err     error
+	)
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &entries)
+	default:
+		err = json.Unmarshal(data, &entries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing lookup table: %w", err)
+	}
+	return NewTable(entries), nil
+}
+
+// merge adds the entries from other to the table, replacing any existing entries for the same refs.
+func (t TableReplacer) merge(other TableReplacer) TableReplacer {
+	if t == nil {
+		t = make(TableReplacer, len(other))
+	}
+	for ref, replace := range other {
+		t[ref] = replace
+	}
+	return t
+}
+
+func (t TableReplacer) Replace(ctx context.Context, sources []Source) error {
+	for i, s := range sources {
+		replace, ok := t[s.Ref]
+		if !ok {
+			continue
+		}
+		sources[i].Replace = replace
+		if e := explanationFor(ctx, s); e != nil {
+			e.Resolver = ResolverTable
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package gnarly
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var calls [][]string
+	record := func(replace map[string]string) Replacer {
+		return ReplacerFunc(func(ctx context.Context, sources []Source) error {
+			var refs []string
+			for i, s := range sources {
+				refs = append(refs, s.Ref)
+				sources[i].Replace = replace[s.Ref]
+			}
+			calls = append(calls, refs)
+			return nil
+		})
+	}
+
+	r := Chain(
+		record(map[string]string{"a": "a2"}),
+		record(map[string]string{"b": "b2", "a": "a3"}),
+		record(nil),
+		record(nil),
+	)
+	sources := []Source{{Ref: "a"}, {Ref: "b"}, {Ref: "c"}}
+	if err := r.Replace(context.Background(), sources); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Source{{Ref: "a", Replace: "a2"}, {Ref: "b", Replace: "b2"}, {Ref: "c"}}
+	if !reflect.DeepEqual(sources, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, sources)
+	}
+	expectedCalls := [][]string{{"a", "b", "c"}, {"b", "c"}, {"c"}, {"c"}}
+	if !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("expected calls %v, got %v", expectedCalls, calls)
+	}
+
+	t.Run("error", func(t *testing.T) {
+		fail := errors.New("failed")
+		r := Chain(ReplacerFunc(func(ctx context.Context, sources []Source) error { return fail }), record(nil))
+		if err := r.Replace(context.Background(), []Source{{Ref: "a"}}); err != fail {
+			t.Fatalf("expected %v, got %v", fail, err)
+		}
+	})
+}
+
+func TestLoadTable(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "lookup.json")
+	if err := os.WriteFile(p, []byte(`{"docker.io/library/golang:1.18": "mcr.microsoft.com/oss/go/microsoft/golang:1.18"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := LoadTable(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := TableReplacer{"docker.io/library/golang:1.18": "mcr.microsoft.com/oss/go/microsoft/golang:1.18"}
+	if !reflect.DeepEqual(table, expected) {
+		t.Fatalf("expected %v, got %v", expected, table)
+	}
+
+	if err := os.WriteFile(p, []byte(`[]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTable(p); err == nil {
+		t.Fatal("expected error for invalid table")
+	}
+}
+
+func TestGenerateReplacer(t *testing.T) {
+	dockerfile := []byte(`
+FROM golang:1.18 AS build
+FROM alpine:3.16
+COPY --from=build / /
+`)
+
+	table := TableReplacer{"docker.io/library/golang:1.18": "mcr.microsoft.com/oss/go/microsoft/golang:1.18"}
+	custom := ReplacerFunc(func(ctx context.Context, sources []Source) error {
+		for i := range sources {
+			sources[i].Replace = "example.com/" + sources[i].Ref
+			sources[i].Reason = "custom"
+		}
+		return nil
+	})
+
+	result, err := Generate(context.Background(), dockerfile, Options{Replacer: Chain(table, custom)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Source{
+		{Type: "docker-image", Ref: "docker.io/library/alpine:3.16", Replace: "example.com/docker.io/library/alpine:3.16", Targets: []string{"stage-1"}, Stages: []string{"stage-1"}, Uses: []string{"from"}, Reason: "custom"},
+		{Type: "docker-image", Ref: "docker.io/library/golang:1.18", Replace: "mcr.microsoft.com/oss/go/microsoft/golang:1.18", Targets: []string{"build", "stage-1"}, Stages: []string{"build"}, Uses: []string{"from"}},
+	}
+	if !reflect.DeepEqual(result.Sources, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, result.Sources)
+	}
+
+	resolvers := []string{result.Explanations[0].Resolver, result.Explanations[1].Resolver}
+	if expected := []string{ResolverReplacer, ResolverTable}; !reflect.DeepEqual(resolvers, expected) {
+		t.Fatalf("expected resolvers %v, got %v", expected, resolvers)
+	}
+}
+
+func TestProgReplacer(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	if _, err := NewProgReplacer(Options{}); err == nil {
+		t.Fatal("expected error without a mod-prog")
+	}
+
+	r, err := NewProgReplacer(Options{ModProg: writeModProg(t, `[ "$1" = docker.io/library/golang:1.18 ] && echo mcr.microsoft.com/oss/go/microsoft/golang:1.18`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := []Source{
+		{Type: "docker-image", Ref: "docker.io/library/golang:1.18"},
+		{Type: "docker-image", Ref: "docker.io/library/alpine:3.16"},
+	}
+	err = r.Replace(context.Background(), sources)
+	var modErr *ModProgError
+	if !errors.As(err, &modErr) || modErr.Ref != "docker.io/library/alpine:3.16" {
+		t.Fatalf("expected ModProgError for alpine, got: %v", err)
+	}
+
+	var failed []string
+	r.OnError = func(err error, sources []Source) error {
+		for _, s := range sources {
+			failed = append(failed, s.Ref)
+		}
+		return nil
+	}
+	if err := r.Replace(context.Background(), sources); err != nil {
+		t.Fatal(err)
+	}
+	if sources[0].Replace != "mcr.microsoft.com/oss/go/microsoft/golang:1.18" || sources[1].Replace != "" {
+		t.Fatalf("unexpected replacements: %+v", sources)
+	}
+	if expected := []string{"docker.io/library/alpine:3.16"}; !reflect.DeepEqual(failed, expected) {
+		t.Fatalf("expected failures for %v, got %v", expected, failed)
+	}
+}
+
+func TestGenerateTable(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	dir := t.TempDir()
+	tablePath := filepath.Join(dir, "lookup.json")
+	if err := os.WriteFile(tablePath, []byte(`{"golang:1.18": "mcr.microsoft.com/oss/go/microsoft/golang:1.18"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rulesPath := filepath.Join(dir, "rules.yaml")
+	if err := os.WriteFile(rulesPath, []byte("- match: ^docker.io/library/(.*)$\n  replace: mirror.example.com/$1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dockerfile := []byte(`
+FROM golang:1.18 AS build
+FROM alpine:3.16
+COPY --from=build / /
+`)
+
+	replacements := func(result Result) map[string]string {
+		m := make(map[string]string)
+		for _, s := range result.Sources {
+			m[s.Ref] = s.Replace
+		}
+		return m
+	}
+
+	t.Run("detected from mod config", func(t *testing.T) {
+		result, err := Generate(context.Background(), dockerfile, Options{ModConfig: []string{rulesPath, tablePath}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{
+			"docker.io/library/alpine:3.16": "mirror.example.com/alpine:3.16",
+			"docker.io/library/golang:1.18": "mcr.microsoft.com/oss/go/microsoft/golang:1.18",
+		}
+		if actual := replacements(result); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+		resolvers := []string{result.Explanations[0].Resolver, result.Explanations[1].Resolver}
+		if expected := []string{ResolverRules, ResolverTable}; !reflect.DeepEqual(resolvers, expected) {
+			t.Fatalf("expected resolvers %v, got %v", expected, resolvers)
+		}
+	})
+
+	t.Run("mod-table with mod-prog", func(t *testing.T) {
+		argsPath := filepath.Join(dir, "args")
+		result, err := Generate(context.Background(), dockerfile, Options{
+			ModProg:  writeModProg(t, `echo "$1" >> `+argsPath+`; echo example.com/replaced`),
+			ModTable: []string{tablePath},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{
+			"docker.io/library/alpine:3.16": "example.com/replaced",
+			"docker.io/library/golang:1.18": "mcr.microsoft.com/oss/go/microsoft/golang:1.18",
+		}
+		if actual := replacements(result); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+
+		data, err := os.ReadFile(argsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "docker.io/library/alpine:3.16\n" {
+			t.Fatalf("expected mod-prog to only be called for refs not in the table, got %q", data)
+		}
+	})
+}
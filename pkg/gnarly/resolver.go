@@ -0,0 +1,153 @@
+package gnarly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/util/imageutil"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func newResolver(log Logger) *metaResolver {
+	return &metaResolver{
+		refs: make(map[string]string),
+		log:  log,
+	}
+}
+
+type metaResolver struct {
+	mu   sync.Mutex
+	refs map[string]string
+	log  Logger
+
+	// When set, real image configs are fetched instead of using the empty config.
+	configs *imageConfigFetcher
+}
+
+const (
+	emptyDigest = digest.Digest("sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a")
+	emptyConfig = "{}"
+)
+
+func (r *metaResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	r.mu.Lock()
+	r.refs[ref] = ref
+	r.mu.Unlock()
+
+	if r.configs != nil {
+		dgst, dt, err := r.configs.Fetch(ctx, ref, opt.Platform)
+		if err == nil {
+			return dgst, dt, nil
+		}
+		r.log.Debug("error resolving image config for", ref, "falling back to empty config:", err)
+	}
+	return emptyDigest, []byte(emptyConfig), nil
+}
+
+// imageConfigFetcher fetches image configs from the registry.
+// Blobs are stored in a content store under the cache dir so they are only downloaded once.
+// Results are also cached by ref so that they can be used when the registry is not reachable.
+type imageConfigFetcher struct {
+	resolver remotes.Resolver
+	content  content.Store
+	refsDir  string
+	log      Logger
+
+	mu   sync.Mutex
+	memo map[string]cachedImageConfig
+}
+
+type cachedImageConfig struct {
+	Digest digest.Digest   `json:"digest"`
+	Config json.RawMessage `json:"config"`
+}
+
+func imageConfigCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gnarly", "image-config"), nil
+}
+
+func newImageConfigFetcher(log Logger) (*imageConfigFetcher, error) {
+	dir, err := imageConfigCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("error getting image config cache dir: %w", err)
+	}
+
+	resolver, err := newRegistryResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := local.NewStore(filepath.Join(dir, "content"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating image config content store: %w", err)
+	}
+
+	refsDir := filepath.Join(dir, "refs")
+	if err := os.MkdirAll(refsDir, 0750); err != nil {
+		return nil, fmt.Errorf("error creating image config cache dir: %w", err)
+	}
+
+	return &imageConfigFetcher{
+		resolver: resolver,
+		content:  store,
+		refsDir:  refsDir,
+		log:      log,
+		memo:     make(map[string]cachedImageConfig),
+	}, nil
+}
+
+// Fetch gets the image config for the ref from the registry, falling back to the on-disk cache if that fails.
+func (f *imageConfigFetcher) Fetch(ctx context.Context, ref string, platform *ocispecs.Platform) (digest.Digest, []byte, error) {
+	key := ref
+	if platform != nil {
+		key += "|" + platforms.Format(*platform)
+	}
+
+	f.mu.Lock()
+	cached, ok := f.memo[key]
+	f.mu.Unlock()
+	if ok {
+		return cached.Digest, cached.Config, nil
+	}
+
+	cachePath := filepath.Join(f.refsDir, digest.FromString(key).Encoded()+".json")
+
+	dgst, dt, err := imageutil.Config(withRegistryLogger(ctx, f.log), ref, f.resolver, f.content, nil, platform)
+	if err != nil {
+		data, readErr := os.ReadFile(cachePath)
+		if readErr != nil {
+			return "", nil, err
+		}
+		if err := json.Unmarshal(data, &cached); err != nil {
+			return "", nil, fmt.Errorf("error parsing cached image config for %s: %w", ref, err)
+		}
+		f.log.Debug("using cached image config for", ref, "after error:", err)
+	} else {
+		cached = cachedImageConfig{Digest: dgst, Config: dt}
+		if data, err := json.Marshal(cached); err == nil {
+			if err := os.WriteFile(cachePath, data, 0600); err != nil {
+				f.log.Debug("error caching image config for", ref+":", err)
+			}
+		}
+	}
+
+	f.mu.Lock()
+	f.memo[key] = cached
+	f.mu.Unlock()
+
+	return cached.Digest, cached.Config, nil
+}
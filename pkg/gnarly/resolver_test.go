@@ -0,0 +1,100 @@
+package gnarly
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestResolveImageConfig(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	config := `{"architecture":"amd64","os":"linux","config":{"Env":["FOO=bar"],"OnBuild":["RUN echo hello"]},"rootfs":{"type":"layers","diff_ids":[]}}`
+	configDigest := digest.FromString(config)
+
+	manifestData, err := json.Marshal(ocispecs.Manifest{
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config: ocispecs.Descriptor{
+			MediaType: ocispecs.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := string(manifestData)
+	manifestDigest := digest.FromString(manifest)
+
+	srv := newTestRegistry(t, "user", "pass", map[string]string{"foo:1.0": manifest}, config)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	withDockerConfig(t, host, "user", "pass")
+
+	ctx := context.Background()
+	platform := &ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+
+	resolve := func(t *testing.T, r *metaResolver, ref string) (digest.Digest, string) {
+		t.Helper()
+		dgst, dt, err := r.ResolveImageConfig(ctx, ref, llb.ResolveImageConfigOpt{Platform: platform})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dgst, string(dt)
+	}
+
+	t.Run("stub", func(t *testing.T) {
+		dgst, dt := resolve(t, newResolver(nopLogger{}), host+"/foo:1.0")
+		if dgst != emptyDigest || dt != emptyConfig {
+			t.Fatalf("expected empty config, got %s: %s", dgst, dt)
+		}
+	})
+
+	t.Run("registry", func(t *testing.T) {
+		r := newResolver(nopLogger{})
+		r.configs, err = newImageConfigFetcher(nopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dgst, dt := resolve(t, r, host+"/foo:1.0")
+		if dgst != manifestDigest {
+			t.Errorf("expected digest %s, got %s", manifestDigest, dgst)
+		}
+		if dt != config {
+			t.Errorf("expected config %s, got %s", config, dt)
+		}
+		if _, ok := r.refs[host+"/foo:1.0"]; !ok {
+			t.Errorf("expected ref to be recorded: %v", r.refs)
+		}
+
+		dgst, dt = resolve(t, r, host+"/foo:missing")
+		if dgst != emptyDigest || dt != emptyConfig {
+			t.Errorf("expected empty config for missing ref, got %s: %s", dgst, dt)
+		}
+	})
+
+	t.Run("offline", func(t *testing.T) {
+		srv.Close()
+
+		r := newResolver(nopLogger{})
+		r.configs, err = newImageConfigFetcher(nopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dgst, dt := resolve(t, r, host+"/foo:1.0")
+		if dgst != manifestDigest || dt != config {
+			t.Errorf("expected cached config, got %s: %s", dgst, dt)
+		}
+
+		dgst, dt = resolve(t, r, host+"/foo:uncached")
+		if dgst != emptyDigest || dt != emptyConfig {
+			t.Errorf("expected empty config for uncached ref, got %s: %s", dgst, dt)
+		}
+	})
+}
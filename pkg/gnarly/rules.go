@@ -0,0 +1,407 @@
+package gnarly
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containerd/containerd/platforms"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule is a rule for the builtin matcher.
+type Rule struct {
+	// ID identifies the rule across mod configs, a rule in a config with higher precedence replaces any rule with the same ID from configs with lower precedence.
+	ID string `json:"id,omitempty" yaml:"id,omitempty" toml:"id,omitempty"`
+	// Match is a regex which is matched against the ref
+	Match string `json:"match" yaml:"match" toml:"match"`
+	// Replace is the replacement for the ref, this can reference capture groups from Match
+	Replace string `json:"replace" yaml:"replace" toml:"replace"`
+	// Ref matches the components of an image ref instead of using Match, this can not be used with Match
+	Ref *RefMatch `json:"ref,omitempty" yaml:"ref,omitempty" toml:"ref,omitempty"`
+	// Set replaces components of a ref matched by Ref
+	Set *RefReplace `json:"set,omitempty" yaml:"set,omitempty" toml:"set,omitempty"`
+	// Type is the source type the rule applies to, defaults to `docker-image`
+	Type string `json:"type,omitempty" yaml:"type,omitempty" toml:"type,omitempty"`
+	// Platforms limits the rule to builds for these platforms, e.g. `linux/amd64` or just `linux`
+	Platforms []string `json:"platforms,omitempty" yaml:"platforms,omitempty" toml:"platforms,omitempty"`
+	// Description is only used for debug output
+	Description string `json:"description,omitempty" yaml:"description,omitempty" toml:"description,omitempty"`
+	// Enabled can be set to false to turn off the rule without removing it, defaults to true
+	Enabled *bool `json:"enabled,omitempty" yaml:"enabled,omitempty" toml:"enabled,omitempty"`
+	// Stop can be set to false to keep applying rules to the replaced ref after this rule matches, defaults to true
+	Stop *bool `json:"stop,omitempty" yaml:"stop,omitempty" toml:"stop,omitempty"`
+	// Chain starts another pass over all the rules with the replaced ref when the rule matches
+	Chain bool `json:"chain,omitempty" yaml:"chain,omitempty" toml:"chain,omitempty"`
+	// Action makes the rule a policy rule instead of a replacement, either `allow` or `deny`
+	Action string `json:"action,omitempty" yaml:"action,omitempty" toml:"action,omitempty"`
+
+	regex     *regexp.Regexp
+	platforms []platforms.Matcher
+	// file is the mod config the rule was loaded from
+	file string
+}
+
+// ruleFile is the format of TOML rule files, which cannot have an array at the top level.
+type ruleFile struct {
+	Rules []Rule `toml:"rules"`
+}
+
+// DefaultMaxRulePasses is the default limit on the number of passes over the rules for a single ref when rules are chained.
+const DefaultMaxRulePasses = 10
+
+// ruleSet is an ordered list of rules for the builtin matcher.
+type ruleSet struct {
+	rules []Rule
+	// policy are the rules with an action, which are checked instead of applied
+	policy []Rule
+	// maxPasses limits how many times rules can be chained, defaults to DefaultMaxRulePasses
+	maxPasses int
+	log       Logger
+}
+
+// loadRules reads rules from the files, from lowest to highest precedence, with the extra rules taking precedence over all of them.
+// Files which are lookup tables are merged into a single table instead, with the same precedence.
+func loadRules(paths []string, extra []Rule) (*ruleSet, TableReplacer, error) {
+	var table TableReplacer
+	layers := make([][]Rule, 0, len(paths)+1)
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading mod config: %w", err)
+		}
+		if isTable(data, filepath.Ext(p)) {
+			t, err := decodeTable(data, filepath.Ext(p))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", p, err)
+			}
+			table = table.merge(t)
+			continue
+		}
+		rules, err := decodeRules(data, filepath.Ext(p))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", p, err)
+		}
+		for i := range rules {
+			rules[i].file = p
+		}
+		layers = append(layers, rules)
+	}
+	rules, err := newRuleSet(append(layers, extra)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rules, table, nil
+}
+
+func parseRules(data []byte, ext string) (*ruleSet, error) {
+	rules, err := decodeRules(data, ext)
+	if err != nil {
+		return nil, err
+	}
+	return newRuleSet(rules)
+}
+
+func decodeRules(data []byte, ext string) ([]Rule, error) {
+	var rules []Rule
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &rules)
+	case ".toml":
+		var f ruleFile
+		err = toml.Unmarshal(data, &f)
+		rules = f.Rules
+	default:
+		err = json.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing mod config for builtin matcher: %w", err)
+	}
+	return rules, nil
+}
+
+// newRuleSet merges layers of rules, from lowest to highest precedence.
+// Rules from layers with higher precedence are applied first, and replace rules with the same ID from layers with lower precedence.
+func newRuleSet(layers ...[]Rule) (*ruleSet, error) {
+	set := &ruleSet{log: nopLogger{}}
+	ids := make(map[string]struct{})
+	for i := len(layers) - 1; i >= 0; i-- {
+		var layerIDs []string
+		for j, rule := range layers[i] {
+			if rule.ID != "" {
+				if _, ok := ids[rule.ID]; ok {
+					continue
+				}
+				layerIDs = append(layerIDs, rule.ID)
+			}
+			// Disabled rules still replace rules with the same ID, which is how a rule from another config is turned off.
+			if rule.Enabled != nil && !*rule.Enabled {
+				continue
+			}
+
+			if err := rule.compile(); err != nil {
+				return nil, fmt.Errorf("%s: %w", rule.location(j), err)
+			}
+			for _, p := range rule.Platforms {
+				m, err := parsePlatformMatcher(p)
+				if err != nil {
+					return nil, fmt.Errorf("error parsing platform for rule %q: %w", rule.Match, err)
+				}
+				rule.platforms = append(rule.platforms, m)
+			}
+			if rule.Type == "" {
+				rule.Type = SourceTypeDockerImage
+			}
+			switch rule.Action {
+			case "":
+				set.rules = append(set.rules, rule)
+			case RuleActionAllow, RuleActionDeny:
+				set.policy = append(set.policy, rule)
+			default:
+				return nil, fmt.Errorf("unknown action for rule %q: %s", rule.Match, rule.Action)
+			}
+		}
+		for _, id := range layerIDs {
+			ids[id] = struct{}{}
+		}
+	}
+	return set, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Ref == nil {
+		// An empty regex would match every ref
+		if r.Match == "" {
+			return errors.New("rule must have a match regex or a ref matcher")
+		}
+		var err error
+		r.regex, err = regexp.Compile(r.Match)
+		if err != nil {
+			return fmt.Errorf("error compiling matcher regex from mod config: %w", err)
+		}
+		return nil
+	}
+
+	if r.Match != "" || r.Replace != "" {
+		return fmt.Errorf("rule can not have both a ref matcher and a match regex: %s", r.Match)
+	}
+	if err := r.Ref.compile(); err != nil {
+		return fmt.Errorf("error compiling ref matcher from mod config: %w", err)
+	}
+	if r.Set != nil {
+		if err := r.Set.compile(); err != nil {
+			return fmt.Errorf("error compiling ref replacement from mod config: %w", err)
+		}
+	}
+	return nil
+}
+
+// matches checks if the rule matches the ref, without replacing it.
+func (r Rule) matches(ref string) bool {
+	if r.Ref == nil {
+		return r.regex.MatchString(ref)
+	}
+	parts, err := parseRefParts(ref)
+	return err == nil && r.Ref.Match(parts)
+}
+
+// location identifies the rule by its index in the mod config it was loaded from, for errors about rules which may not have an ID or description.
+func (r Rule) location(i int) string {
+	loc := fmt.Sprintf("rule %d", i)
+	if s := r.String(); s != "" {
+		loc += fmt.Sprintf(" (%s)", s)
+	}
+	if r.file != "" {
+		loc += " in " + r.file
+	}
+	return loc
+}
+
+// String identifies the rule in reports, using the ID or description if it has one.
+func (r Rule) String() string {
+	switch {
+	case r.ID != "":
+		return r.ID
+	case r.Description != "":
+		return r.Description
+	case r.Ref != nil:
+		return r.Ref.String()
+	default:
+		return r.Match
+	}
+}
+
+// apply returns the replaced ref and true if the rule matches the ref.
+// An error is returned if the rule matches but the replaced ref is invalid.
+func (r Rule) apply(ref string) (string, bool, error) {
+	if r.Ref == nil {
+		if !r.regex.MatchString(ref) {
+			return "", false, nil
+		}
+		return r.regex.ReplaceAllString(ref, r.Replace), true, nil
+	}
+
+	parts, err := parseRefParts(ref)
+	if err != nil || !r.Ref.Match(parts) {
+		return "", false, nil
+	}
+	if r.Set == nil {
+		return ref, true, nil
+	}
+	parts, ok := r.Set.Apply(parts)
+	if !ok {
+		return "", false, nil
+	}
+	replaced, err := parts.String()
+	if err != nil {
+		return "", false, err
+	}
+	return replaced, true, nil
+}
+
+// osMatcher matches any platform with the OS.
+type osMatcher string
+
+func (m osMatcher) Match(p ocispecs.Platform) bool {
+	return p.OS == string(m)
+}
+
+// parsePlatformMatcher parses a platform for a rule.
+// A platform with only an OS matches all architectures, unlike platforms.Parse which would fill in the architecture of the host.
+func parsePlatformMatcher(p string) (platforms.Matcher, error) {
+	if !strings.Contains(p, "/") {
+		return osMatcher(strings.ToLower(p)), nil
+	}
+	spec, err := platforms.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	return platforms.NewMatcher(spec), nil
+}
+
+func (r Rule) applies(typ string, platform ocispecs.Platform) bool {
+	if r.Type != typ {
+		return false
+	}
+	if len(r.platforms) == 0 {
+		return true
+	}
+	for _, m := range r.platforms {
+		if m.Match(platform) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlatform parses the platform of the build, falling back to the default platform if it is invalid.
+func parsePlatform(platform string, log Logger) ocispecs.Platform {
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		log.Debug("error parsing platform", platform+":", err)
+		return platforms.DefaultSpec()
+	}
+	return p
+}
+
+// Replace applies the rules to the ref and returns the replacement, or an empty string if no rule matched.
+// Rules are applied in order until a rule with `stop` (the default) matches, rules after a matching rule without `stop` are matched against the replaced ref.
+// If any matching rule has `chain` set, the rules are applied again to the replaced ref until no chained rule matches.
+// An error is returned if chained rules replace a ref with one seen in an earlier pass, or if there are too many passes.
+func (s *ruleSet) Replace(typ, ref, platform string) (string, error) {
+	replace, _, err := s.Explain(typ, ref, platform)
+	return replace, err
+}
+
+// Explain is the same as Replace, but also returns every rule which was tried.
+func (s *ruleSet) Explain(typ, ref, platform string) (string, []RuleTrial, error) {
+	if s == nil {
+		return "", nil, nil
+	}
+
+	p := parsePlatform(platform, s.log)
+
+	maxPasses := s.maxPasses
+	if maxPasses <= 0 {
+		maxPasses = DefaultMaxRulePasses
+	}
+
+	var (
+		replace string
+		trials  []RuleTrial
+	)
+	seen := []string{ref}
+	for cur := ref; ; {
+		next, matched, chain, tried, err := s.pass(typ, cur, p, len(seen))
+		trials = append(trials, tried...)
+		if err != nil {
+			return "", trials, err
+		}
+		if !matched {
+			break
+		}
+		replace = next
+		// A chained rule which does not change the ref has nothing more to do
+		if !chain || next == cur {
+			break
+		}
+		for _, v := range seen {
+			if v == next {
+				return "", trials, fmt.Errorf("cycle in chained rules: %s", strings.Join(append(seen, next), " -> "))
+			}
+		}
+		if len(seen) >= maxPasses {
+			return "", trials, fmt.Errorf("chained rules for %s exceeded the limit of %d passes", ref, maxPasses)
+		}
+		seen = append(seen, next)
+		cur = next
+	}
+	return replace, trials, nil
+}
+
+// pass applies the rules once, returning the replaced ref, if any rule matched, if any of the matching rules are chained and the rules which were tried.
+func (s *ruleSet) pass(typ, ref string, p ocispecs.Platform, n int) (string, bool, bool, []RuleTrial, error) {
+	var (
+		matched, chain bool
+		trials         []RuleTrial
+	)
+	cur := ref
+	for i, rule := range s.rules {
+		if !rule.applies(typ, p) {
+			continue
+		}
+		next, ok, err := rule.apply(cur)
+		if err != nil {
+			return "", false, false, trials, fmt.Errorf("error replacing %s with rule %s: %w", cur, rule.String(), err)
+		}
+		trial := RuleTrial{Pass: n, Index: i, Rule: rule.String(), File: rule.file, Ref: cur}
+		if ok {
+			trial.Matched = true
+			trial.Result = next
+		}
+		trials = append(trials, trial)
+		if !ok {
+			continue
+		}
+		s.log.Debug("rule", rule.Match, rule.Description, "matched", cur, "replaced with", next)
+		cur = next
+		matched = true
+		chain = chain || rule.Chain
+		if rule.Stop == nil || *rule.Stop {
+			break
+		}
+	}
+	return cur, matched, chain, trials, nil
+}
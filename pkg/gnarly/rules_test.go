@@ -0,0 +1,384 @@
+package gnarly
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	for ext, data := range map[string]string{
+		".json": `[{"match": "^docker.io/library/(.*)$", "replace": "mcr.microsoft.com/$1", "description": "mirror"}]`,
+		".yaml": `
+# Mirror official images
+- match: ^docker.io/library/(.*)$
+  replace: mcr.microsoft.com/$1
+  description: mirror
+`,
+		".toml": `
+# Mirror official images
+[[rules]]
+match = '^docker.io/library/(.*)$'
+replace = 'mcr.microsoft.com/$1'
+description = 'mirror'
+`,
+	} {
+		rules, err := parseRules([]byte(data), ext)
+		if err != nil {
+			t.Fatal(ext, err)
+		}
+		if len(rules.rules) != 1 || rules.rules[0].Description != "mirror" {
+			t.Fatalf("%s: unexpected rules: %+v", ext, rules.rules)
+		}
+		if v, _ := rules.Replace(SourceTypeDockerImage, "docker.io/library/golang:1.18", "linux/amd64"); v != "mcr.microsoft.com/golang:1.18" {
+			t.Errorf("%s: unexpected replacement: %s", ext, v)
+		}
+	}
+
+	if _, err := parseRules([]byte("- match: [\n"), ".yml"); err == nil {
+		t.Error("expected error for invalid yaml")
+	}
+	if _, err := parseRules([]byte(`[{"match": "("}]`), ".json"); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+	for _, data := range []string{`[{"replace": "mcr.microsoft.com/golang"}]`, `[{"action": "deny"}]`} {
+		_, err := parseRules([]byte(data), ".json")
+		if err == nil {
+			t.Errorf("expected error for rule without a match or ref: %s", data)
+		} else if !strings.HasPrefix(err.Error(), "rule 0: ") {
+			t.Errorf("expected error to identify the rule by index, got: %v", err)
+		}
+	}
+}
+
+func TestRuleSetReplace(t *testing.T) {
+	rules, err := parseRules([]byte(`
+- match: ^docker.io/library/disabled:(.*)$
+  replace: example.com/disabled:$1
+  enabled: false
+- match: ^docker.io/library/(.*)$
+  replace: mirror.example.com/library/$1
+  stop: false
+- match: ^mirror.example.com/library/golang:(.*)$
+  replace: mirror.example.com/library/golang:$1-windows
+  platforms: [windows]
+- match: ^mirror.example.com/(.*):(.*)$
+  replace: mirror.example.com/$1:$2-arm
+  platforms: [linux/arm64, linux/arm/v7]
+- match: ^mirror.example.com/(.*)$
+  replace: mirror.example.com/$1
+- match: ^mirror.example.com/(.*)$
+  replace: unreachable.example.com/$1
+- match: ^https://github.com/(.*)$
+  replace: https://git.example.com/$1
+  type: git
+`), ".yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		typ, ref, platform, expected string
+	}{
+		{SourceTypeDockerImage, "docker.io/library/golang:1.18", "linux/amd64", "mirror.example.com/library/golang:1.18"},
+		{SourceTypeDockerImage, "docker.io/library/golang:1.18", "windows/amd64", "mirror.example.com/library/golang:1.18-windows"},
+		{SourceTypeDockerImage, "docker.io/library/golang:1.18", "linux/arm64", "mirror.example.com/library/golang:1.18-arm"},
+		{SourceTypeDockerImage, "docker.io/library/disabled:1", "linux/amd64", "mirror.example.com/library/disabled:1"},
+		{SourceTypeDockerImage, "example.com/foo:1", "linux/amd64", ""},
+		{SourceTypeDockerImage, "https://github.com/foo/bar.git", "linux/amd64", ""},
+		{SourceTypeGit, "https://github.com/foo/bar.git", "linux/amd64", "https://git.example.com/foo/bar.git"},
+	} {
+		v, err := rules.Replace(tc.typ, tc.ref, tc.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != tc.expected {
+			t.Errorf("%s %s on %s: expected %q, got %q", tc.typ, tc.ref, tc.platform, tc.expected, v)
+		}
+	}
+}
+
+func TestRuleSetChain(t *testing.T) {
+	rules, err := parseRules([]byte(`
+- description: normalize
+  match: ^golang:(.*)$
+  replace: docker.io/library/golang:$1
+  chain: true
+- description: mirror
+  match: ^docker.io/library/(.*)$
+  replace: mirror.example.com/library/$1
+  chain: true
+- description: tag policy
+  match: ^mirror.example.com/library/golang:1.18$
+  replace: mirror.example.com/library/golang:1.18.3
+  chain: true
+- description: cycle
+  match: ^(a|b)$
+  replace: x$1
+  chain: true
+- match: ^xa$
+  replace: b
+  chain: true
+- match: ^xb$
+  replace: a
+  chain: true
+`), ".yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := rules.Replace(SourceTypeDockerImage, "golang:1.18", "linux/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "mirror.example.com/library/golang:1.18.3" {
+		t.Errorf("unexpected replacement: %s", v)
+	}
+
+	if _, err := rules.Replace(SourceTypeDockerImage, "a", "linux/amd64"); err == nil || !strings.Contains(err.Error(), "a -> xa -> b -> xb -> a") {
+		t.Errorf("expected cycle error, got: %v", err)
+	}
+
+	rules.maxPasses = 2
+	if _, err := rules.Replace(SourceTypeDockerImage, "golang:1.18", "linux/amd64"); err == nil {
+		t.Error("expected error when exceeding max passes")
+	}
+}
+
+func TestRuleSetRef(t *testing.T) {
+	rules, err := parseRules([]byte(`
+- description: go mirror
+  ref:
+    domain: docker.io
+    repo: library/golang
+    tagRange: ">=1.17, <1.19"
+  set:
+    domain: mcr.microsoft.com
+    repo: oss/go/microsoft/$repo
+- description: pin alpine
+  ref:
+    repo: library/alpine
+    tag: "3.1*"
+  set:
+    tag: $tag.0
+- description: any ghcr digest
+  ref:
+    domain: ghcr.io
+    digest: sha256:*
+  set:
+    domain: mirror.example.com
+    digest: $digest
+`), ".yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const dgst = "sha256:5b0c1fa7a3b9d4c5c6ab1a4b5e0b0c0d0e0f000102030405060708090a0b0c0d"
+	for _, tc := range []struct {
+		ref, expected string
+	}{
+		{"golang:1.18", "mcr.microsoft.com/oss/go/microsoft/library/golang:1.18"},
+		{"golang:1.18.3", "mcr.microsoft.com/oss/go/microsoft/library/golang:1.18.3"},
+		{"golang:1.19", ""},
+		{"golang:latest", ""},
+		{"golang:1.18@" + dgst, "mcr.microsoft.com/oss/go/microsoft/library/golang:1.18"},
+		{"alpine:3.16", "docker.io/library/alpine:3.16.0"},
+		{"alpine:edge", ""},
+		{"ghcr.io/foo/bar@" + dgst, "mirror.example.com/foo/bar@" + dgst},
+		{"ghcr.io/foo/bar:1", ""},
+		{"not a ref", ""},
+	} {
+		v, err := rules.Replace(SourceTypeDockerImage, tc.ref, "linux/amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.ref, tc.expected, v)
+		}
+	}
+
+	for _, data := range []string{
+		`[{"ref": {"tagRange": "not a range"}}]`,
+		`[{"ref": {"repo": "["}}]`,
+		`[{"match": "^foo$", "ref": {"repo": "foo"}}]`,
+	} {
+		if _, err := parseRules([]byte(data), ".json"); err == nil {
+			t.Errorf("expected error for %s", data)
+		}
+	}
+
+	invalid, err := parseRules([]byte(`[{"ref": {"repo": "library/golang"}, "set": {"repo": "Invalid/$repo"}}]`), ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := invalid.Replace(SourceTypeDockerImage, "golang:1.18", "linux/amd64"); err == nil {
+		t.Error("expected error for a rule which sets an invalid ref")
+	}
+}
+
+func TestRuleSetTagPolicy(t *testing.T) {
+	rules, err := parseRules([]byte(`
+- description: old go patches are not mirrored
+  ref:
+    repo: library/golang
+    tagRange: ">=1.17.1, <=1.17.8"
+  set:
+    domain: mcr.microsoft.com
+    repo: oss/go/microsoft/golang
+    tag: "1.17"
+- description: upgrade to the latest mirrored patch
+  ref:
+    repo: library/golang
+    tagRange: ">=1.17"
+    variant: "-"
+  set:
+    domain: mcr.microsoft.com
+    repo: oss/go/microsoft/golang
+    tagPolicy: latest-patch
+    tags: ["1.17", "1.17.9", "1.17.10", "1.18", "1.18.3", "1.18.3-bullseye", "1.19.0"]
+- description: alpine variants
+  ref:
+    repo: library/golang
+    variant: alpine*
+  set:
+    domain: mcr.microsoft.com
+    repo: oss/go/microsoft/golang
+    tagPolicy: latest-minor
+    tags: ["1.17.10-alpine", "1.18.3-alpine", "1.18.2-alpine", "2.0.0-alpine"]
+`), ".yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ref, expected string
+	}{
+		{"golang:1.17.8-alpine", "mcr.microsoft.com/oss/go/microsoft/golang:1.17"},
+		{"golang:1.17.9", "mcr.microsoft.com/oss/go/microsoft/golang:1.17.10"},
+		{"golang:1.17", "mcr.microsoft.com/oss/go/microsoft/golang:1.17.10"},
+		{"golang:1.18", "mcr.microsoft.com/oss/go/microsoft/golang:1.18.3"},
+		{"golang:v1.18.1", "mcr.microsoft.com/oss/go/microsoft/golang:1.18.3"},
+		{"golang:1.18-bullseye", ""},
+		{"golang:1.16", ""},
+		{"golang:1.20", ""},
+		{"golang:latest", ""},
+		{"golang:1.17.9-alpine", "mcr.microsoft.com/oss/go/microsoft/golang:1.18.3-alpine"},
+		{"golang:1.19-alpine", ""},
+	} {
+		v, err := rules.Replace(SourceTypeDockerImage, tc.ref, "linux/amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.ref, tc.expected, v)
+		}
+	}
+
+	for _, data := range []string{
+		`[{"ref": {"repo": "library/golang"}, "set": {"tagPolicy": "newest", "tags": ["1.18"]}}]`,
+		`[{"ref": {"repo": "library/golang"}, "set": {"tagPolicy": "latest"}}]`,
+	} {
+		if _, err := parseRules([]byte(data), ".json"); err == nil {
+			t.Errorf("expected error for %s", data)
+		}
+	}
+}
+
+func TestLoadRulesLayers(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"org.json": `[
+	{"id": "mirror", "match": "^docker.io/library/(.*)$", "replace": "org.example.com/$1"},
+	{"id": "node", "match": "^docker.io/library/node:(.*)$", "replace": "org.example.com/node:$1"},
+	{"match": "^quay.io/(.*)$", "replace": "org.example.com/quay/$1"}
+]`,
+		"team.yaml": `
+- id: node
+  enabled: false
+- match: ^quay.io/team/(.*)$
+  replace: team.example.com/$1
+`,
+		".gnarly.toml": `
+[[rules]]
+id = 'mirror'
+match = '^docker.io/library/(.*)$'
+replace = 'repo.example.com/$1'
+`,
+	}
+	var paths []string
+	for _, name := range []string{"org.json", "team.yaml", ".gnarly.toml"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(files[name]), 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+
+	rules, _, err := loadRules(paths, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ref, expected := range map[string]string{
+		"docker.io/library/golang:1.18": "repo.example.com/golang:1.18",
+		"docker.io/library/node:18":     "repo.example.com/node:18",
+		"quay.io/team/foo":              "team.example.com/foo",
+		"quay.io/other/foo":             "org.example.com/quay/other/foo",
+	} {
+		v, err := rules.Replace(SourceTypeDockerImage, ref, "linux/amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != expected {
+			t.Errorf("%s: expected %s, got %s", ref, expected, v)
+		}
+	}
+
+	t.Run("extra rules", func(t *testing.T) {
+		rules, _, err := loadRules(paths, []Rule{{ID: "mirror", Match: "^docker.io/library/(.*)$", Replace: "extra.example.com/$1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := rules.Replace(SourceTypeDockerImage, "docker.io/library/golang:1.18", "linux/amd64"); v != "extra.example.com/golang:1.18" {
+			t.Errorf("expected extra rule to take precedence, got %s", v)
+		}
+	})
+
+	t.Run("lookup tables", func(t *testing.T) {
+		tables := map[string]string{
+			"lookup.json": `{"golang:1.18": "org.example.com/golang:1.18", "alpine": "org.example.com/alpine"}`,
+			"lookup.yaml": "docker.io/library/alpine:latest: team.example.com/alpine\n",
+		}
+		paths := paths
+		for _, name := range []string{"lookup.json", "lookup.yaml"} {
+			p := filepath.Join(dir, name)
+			if err := os.WriteFile(p, []byte(tables[name]), 0600); err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, p)
+		}
+
+		rules, table, err := loadRules(paths, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := rules.Replace(SourceTypeDockerImage, "docker.io/library/golang:1.18", "linux/amd64"); v != "repo.example.com/golang:1.18" {
+			t.Errorf("expected rules to still be loaded, got %s", v)
+		}
+		expected := TableReplacer{
+			"golang:1.18":                     "org.example.com/golang:1.18",
+			"docker.io/library/golang:1.18":   "org.example.com/golang:1.18",
+			"alpine":                          "org.example.com/alpine",
+			"docker.io/library/alpine:latest": "team.example.com/alpine",
+		}
+		if !reflect.DeepEqual(table, expected) {
+			t.Errorf("expected %v, got %v", expected, table)
+		}
+	})
+
+	if _, _, err := loadRules([]string{filepath.Join(dir, "missing.json")}, nil); err == nil {
+		t.Error("expected error for missing config")
+	}
+}
@@ -0,0 +1,140 @@
+package gnarly
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// Source types, these match the source types used by buildkit.
+const (
+	SourceTypeDockerImage = "docker-image"
+	SourceTypeGit         = "git"
+	SourceTypeHTTP        = "http"
+	SourceTypeLocal       = "local"
+	SourceTypeOCILayout   = "oci-layout"
+)
+
+// contextTypeTarget is the type of a `target:` context, which bake uses to build another target for the context.
+// It is not a source, so it is never replaced or checked against policy.
+const contextTypeTarget = "target"
+
+var (
+	httpPrefix                   = regexp.MustCompile(`^https?://`)
+	gitURLPathWithFragmentSuffix = regexp.MustCompile(`\.git(?:#.+)?$`)
+)
+
+// IsGitContext determines if the build context is a remote git repository.
+// This follows the same rules that buildkit uses to detect git contexts, with the addition of `file://` URLs ending in `.git`, which is useful for local bare repos.
+func IsGitContext(buildCtx string) bool {
+	for _, prefix := range []string{"git://", "github.com/", "git@"} {
+		if strings.HasPrefix(buildCtx, prefix) {
+			return true
+		}
+	}
+	if httpPrefix.MatchString(buildCtx) || strings.HasPrefix(buildCtx, "file://") {
+		return gitURLPathWithFragmentSuffix.MatchString(buildCtx)
+	}
+	return false
+}
+
+// ContextSource gets the source type and ref for a value passed to `--build-context`, using the same rules as buildx.
+// Image refs are normalized, the same as every other image source, so rules and policy match them.
+// Contexts which build another bake target (`target:<name>`) have the type `target` and the name of the target as the ref.
+func ContextSource(value string) (string, string) {
+	switch {
+	case strings.HasPrefix(value, "docker-image://"):
+		ref := strings.TrimPrefix(value, "docker-image://")
+		if normalized, err := normalizeRef(ref); err == nil {
+			ref = normalized
+		}
+		return SourceTypeDockerImage, ref
+	case strings.HasPrefix(value, "oci-layout://"):
+		return SourceTypeOCILayout, strings.TrimPrefix(value, "oci-layout://")
+	case strings.HasPrefix(value, "target:"):
+		return contextTypeTarget, strings.TrimPrefix(value, "target:")
+	case IsGitContext(value):
+		return SourceTypeGit, value
+	case httpPrefix.MatchString(value):
+		return SourceTypeHTTP, value
+	default:
+		return SourceTypeLocal, value
+	}
+}
+
+// urlSource gets the source type for a source path passed to `ADD`.
+// Returns false if the path is not a remote source.
+func urlSource(src string) (string, bool) {
+	switch {
+	case IsGitContext(src):
+		return SourceTypeGit, true
+	case httpPrefix.MatchString(src):
+		return SourceTypeHTTP, true
+	default:
+		return "", false
+	}
+}
+
+// contextName normalizes the name of a named context the same way the Dockerfile frontend does when looking it up.
+func contextName(name string) string {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return name
+	}
+	return strings.TrimSuffix(reference.FamiliarString(named), ":latest")
+}
+
+// BuildContext returns the `<name>=<value>` for passing the replacement to `--build-context`.
+// Returns false if there is no replacement, the source cannot be replaced with a named context (e.g. a URL passed to `ADD`) or the source is not used by this build.
+func (s Source) BuildContext() (string, bool) {
+	if s.Replace == "" || s.onbuildOnly() {
+		return "", false
+	}
+
+	name := s.Name
+	if name == "" {
+		if s.Type != SourceTypeDockerImage {
+			return "", false
+		}
+		name = s.Ref
+	}
+
+	return name + "=" + contextValue(s.Type, s.Replace), true
+}
+
+// onbuildOnly checks if the source is only used by `ONBUILD` triggers in the Dockerfile.
+// Triggers only run when another build uses the stage as its base, so the source is never pulled by this build.
+func (s Source) onbuildOnly() bool {
+	return len(s.Uses) == 1 && s.Uses[0] == useOnbuild
+}
+
+// contextValue converts a replacement into a value for `--build-context`.
+// Replacements which are already in a form buildx understands are returned as is, otherwise the replacement is assumed to be the same type as the source.
+func contextValue(typ, replace string) string {
+	for _, prefix := range []string{"docker-image://", "oci-layout://", "target:", "/", "./", "../"} {
+		if strings.HasPrefix(replace, prefix) {
+			return replace
+		}
+	}
+	if IsGitContext(replace) || httpPrefix.MatchString(replace) {
+		return replace
+	}
+
+	switch typ {
+	case SourceTypeDockerImage, SourceTypeOCILayout:
+		return typ + "://" + replace
+	}
+	return replace
+}
+
+// ReplacedContext finds the source which replaces the named context.
+func ReplacedContext(sources []Source, name string) (Source, bool) {
+	name = contextName(name)
+	for _, s := range sources {
+		if s.Name != "" && s.Name == name && s.Replace != "" {
+			return s, true
+		}
+	}
+	return Source{}, false
+}
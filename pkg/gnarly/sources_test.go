@@ -0,0 +1,60 @@
+package gnarly
+
+import "testing"
+
+func TestContextSource(t *testing.T) {
+	for value, expected := range map[string][2]string{
+		"docker-image://alpine:3.16":             {SourceTypeDockerImage, "docker.io/library/alpine:3.16"},
+		"docker-image://alpine":                  {SourceTypeDockerImage, "docker.io/library/alpine:latest"},
+		"oci-layout:///tmp/layout@sha256:abc":    {SourceTypeOCILayout, "/tmp/layout@sha256:abc"},
+		"https://github.com/deislabs/gnarly.git": {SourceTypeGit, "https://github.com/deislabs/gnarly.git"},
+		"git@github.com:deislabs/gnarly.git":     {SourceTypeGit, "git@github.com:deislabs/gnarly.git"},
+		"https://example.com/context.tar.gz":     {SourceTypeHTTP, "https://example.com/context.tar.gz"},
+		"../deps":                                {SourceTypeLocal, "../deps"},
+		"target:base":                            {contextTypeTarget, "base"},
+	} {
+		typ, ref := ContextSource(value)
+		if typ != expected[0] || ref != expected[1] {
+			t.Errorf("%s: expected %v, got [%s %s]", value, expected, typ, ref)
+		}
+	}
+}
+
+func TestBuildContext(t *testing.T) {
+	for _, tc := range []struct {
+		source   Source
+		expected string
+	}{
+		{Source{Type: SourceTypeDockerImage, Ref: "docker.io/library/alpine:3.16", Replace: "mcr.microsoft.com/alpine:3.16"}, "docker.io/library/alpine:3.16=docker-image://mcr.microsoft.com/alpine:3.16"},
+		{Source{Type: SourceTypeDockerImage, Ref: "docker.io/library/alpine:3.16", Replace: "oci-layout:///tmp/layout"}, "docker.io/library/alpine:3.16=oci-layout:///tmp/layout"},
+		{Source{Type: SourceTypeLocal, Ref: "../deps", Name: "deps", Replace: "/src/deps"}, "deps=/src/deps"},
+		{Source{Type: SourceTypeGit, Ref: "https://github.com/foo/bar.git", Name: "bar", Replace: "https://mirror.example.com/foo/bar.git"}, "bar=https://mirror.example.com/foo/bar.git"},
+		{Source{Type: SourceTypeDockerImage, Ref: "alpine:3.17", Name: "alpine", Replace: "mcr.microsoft.com/alpine:3.17"}, "alpine=docker-image://mcr.microsoft.com/alpine:3.17"},
+		{Source{Type: SourceTypeHTTP, Ref: "https://example.com/tool.tar.gz", Replace: "https://mirror.example.com/tool.tar.gz"}, ""},
+		{Source{Type: SourceTypeDockerImage, Ref: "docker.io/library/alpine:3.16"}, ""},
+	} {
+		bc, ok := tc.source.BuildContext()
+		if ok != (tc.expected != "") || bc != tc.expected {
+			t.Errorf("%+v: expected %q, got %q", tc.source, tc.expected, bc)
+		}
+	}
+}
+
+func TestIsGitContext(t *testing.T) {
+	for ctx, expected := range map[string]bool{
+		"git://github.com/deislabs/gnarly":                 true,
+		"git@github.com:deislabs/gnarly.git":               true,
+		"github.com/deislabs/gnarly":                       true,
+		"https://github.com/deislabs/gnarly.git":           true,
+		"https://github.com/deislabs/gnarly.git#main:test": true,
+		"https://github.com/deislabs/gnarly":               false,
+		"https://example.com/context.tar.gz":               false,
+		"file:///tmp/repo.git#main":                        true,
+		".":                                                false,
+		"-":                                                false,
+	} {
+		if IsGitContext(ctx) != expected {
+			t.Errorf("%s: expected %v", ctx, expected)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package gnarly
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	dfparser "github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
+)
+
+// Ways an image can be used by a stage
+const (
+	// Base image of the stage
+	useFrom = "from"
+	// `COPY --from=<image>`
+	useCopy = "copy"
+	// `RUN --mount=from=<image>`
+	useMount = "mount"
+	// `COPY --from` or `RUN --mount from=` in an `ONBUILD` trigger
+	useOnbuild = "onbuild"
+	// `ADD <url>`
+	useAdd = "add"
+)
+
+// stage is a build stage from a Dockerfile.
+type stage struct {
+	// Name of the stage, unnamed stages get the same name as they would in buildkit (`stage-<index>`).
+	Name string
+	// Ref is the normalized image ref for the base of the stage.
+	// This is empty if the stage is based on scratch or on another stage.
+	Ref string
+	// Deps are the indexes of other stages this stage depends on, either as a base or through `COPY --from` and `RUN --mount from=`.
+	Deps []int
+	// Sources are all the external sources used by the stage, including the base image.
+	Sources []sourceUse
+}
+
+type sourceUse struct {
+	Type string
+	// Ref is the normalized image ref for images, or the URL for other sources
+	Ref  string
+	Kind string
+}
+
+// commandFroms gets the sources a command reads from through `COPY --from` or `RUN --mount from=`.
+func commandFroms(cmd interface{}) ([]string, string) {
+	var froms []string
+	switch c := cmd.(type) {
+	case *instructions.CopyCommand:
+		if c.From != "" {
+			froms = append(froms, c.From)
+		}
+		return froms, useCopy
+	case *instructions.RunCommand:
+		for _, m := range instructions.GetMounts(c) {
+			if m.From != "" {
+				froms = append(froms, m.From)
+			}
+		}
+		return froms, useMount
+	}
+	return nil, ""
+}
+
+// onbuildFroms gets the sources used by an `ONBUILD` trigger.
+func onbuildFroms(c *instructions.OnbuildCommand) ([]string, error) {
+	node, err := dfparser.Parse(strings.NewReader(c.Expression))
+	if err != nil {
+		return nil, err
+	}
+
+	var froms []string
+	for _, n := range node.AST.Children {
+		ic, err := instructions.ParseInstruction(n)
+		if err != nil {
+			return nil, err
+		}
+		f, _ := commandFroms(ic)
+		froms = append(froms, f...)
+	}
+	return froms, nil
+}
+
+func normalizeRef(name string) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", err
+	}
+	return reference.TagNameOnly(ref).String(), nil
+}
+
+// parseStages parses the Dockerfile and expands the base image for every stage using the same rules as dockerfile2llb.
+func parseStages(dt []byte, buildArgs map[string]string) ([]stage, error) {
+	dockerfile, err := dfparser.Parse(bytes.NewReader(dt))
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, metaArgs, err := instructions.Parse(dockerfile.AST)
+	if err != nil {
+		return nil, err
+	}
+
+	shlex := shell.NewLex(dockerfile.EscapeToken)
+
+	args := platformArgs()
+	for _, cmd := range metaArgs {
+		for _, arg := range cmd.Args {
+			if v, ok := buildArgs[arg.Key]; ok {
+				args[arg.Key] = v
+				continue
+			}
+			if arg.Value == nil {
+				continue
+			}
+			v, err := shlex.ProcessWordWithMap(*arg.Value, args)
+			if err != nil {
+				return nil, err
+			}
+			args[arg.Key] = v
+		}
+	}
+
+	stages := make([]stage, 0, len(parsed))
+	names := make(map[string]int, len(parsed))
+	for i, st := range parsed {
+		if st.Name != "" {
+			if _, ok := names[strings.ToLower(st.Name)]; !ok {
+				names[strings.ToLower(st.Name)] = i
+			}
+		}
+	}
+
+	// findStage looks up a stage by name or index, as used by `COPY --from` and `RUN --mount from=`
+	findStage := func(from string) (int, bool) {
+		if i, err := strconv.Atoi(from); err == nil {
+			return i, i >= 0 && i < len(parsed)
+		}
+		i, ok := names[strings.ToLower(from)]
+		return i, ok
+	}
+
+	for i, st := range parsed {
+		s := stage{Name: st.Name}
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("stage-%d", i)
+		}
+
+		name, err := shlex.ProcessWordWithMap(st.BaseName, args)
+		if err != nil {
+			return nil, dfparser.WithLocation(err, st.Location)
+		}
+
+		// Only earlier stages can be used as a base
+		if base, ok := names[strings.ToLower(name)]; ok && base < i {
+			s.Deps = append(s.Deps, base)
+		} else if !strings.EqualFold(name, "scratch") {
+			s.Ref, err = normalizeRef(name)
+			if err != nil {
+				return nil, dfparser.WithLocation(fmt.Errorf("failed to parse stage name %q: %w", name, err), st.Location)
+			}
+			s.Sources = append(s.Sources, sourceUse{Type: SourceTypeDockerImage, Ref: s.Ref, Kind: useFrom})
+		}
+
+		for _, cmd := range st.Commands {
+			if c, ok := cmd.(*instructions.OnbuildCommand); ok {
+				froms, err := onbuildFroms(c)
+				if err != nil {
+					return nil, dfparser.WithLocation(err, c.Location())
+				}
+				// Stages referenced in the trigger are from the Dockerfile which uses this image as a base, so only numeric indexes can be ignored.
+				for _, from := range froms {
+					if _, err := strconv.Atoi(from); err == nil {
+						continue
+					}
+					if ref, err := normalizeRef(from); err == nil {
+						s.Sources = append(s.Sources, sourceUse{Type: SourceTypeDockerImage, Ref: ref, Kind: useOnbuild})
+					}
+				}
+				continue
+			}
+
+			if c, ok := cmd.(*instructions.AddCommand); ok {
+				for _, src := range c.SourcePaths {
+					src, err := shlex.ProcessWordWithMap(src, args)
+					if err != nil {
+						return nil, dfparser.WithLocation(err, c.Location())
+					}
+					if typ, ok := urlSource(src); ok {
+						s.Sources = append(s.Sources, sourceUse{Type: typ, Ref: src, Kind: useAdd})
+					}
+				}
+				continue
+			}
+
+			froms, kind := commandFroms(cmd)
+			for _, from := range froms {
+				if dep, ok := findStage(from); ok {
+					s.Deps = append(s.Deps, dep)
+					continue
+				}
+				if ref, err := normalizeRef(from); err == nil {
+					s.Sources = append(s.Sources, sourceUse{Type: SourceTypeDockerImage, Ref: ref, Kind: kind})
+				}
+			}
+		}
+
+		stages = append(stages, s)
+	}
+
+	return stages, nil
+}
+
+// DefaultTarget gets the name of the stage which is built when no target is specified, which is the last stage.
+func DefaultTarget(dt []byte, buildArgs map[string]string) (string, error) {
+	stages, err := parseStages(dt, buildArgs)
+	if err != nil {
+		return "", fmt.Errorf("error parsing dockerfile: %w", err)
+	}
+	if len(stages) == 0 {
+		return "", nil
+	}
+	return stages[len(stages)-1].Name, nil
+}
+
+// reachableStages gets the names of all stages which are needed to build the target stage.
+// If the target is empty the last stage is used, as it is the default target.
+func reachableStages(stages []stage, target string) map[string]struct{} {
+	reachable := make(map[string]struct{})
+	if len(stages) == 0 {
+		return reachable
+	}
+
+	idx := len(stages) - 1
+	if target != "" {
+		idx = -1
+		for i, s := range stages {
+			if strings.EqualFold(s.Name, target) {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			return reachable
+		}
+	}
+
+	var visit func(i int)
+	visit = func(i int) {
+		if _, ok := reachable[stages[i].Name]; ok {
+			return
+		}
+		reachable[stages[i].Name] = struct{}{}
+		for _, dep := range stages[i].Deps {
+			visit(dep)
+		}
+	}
+	visit(idx)
+
+	return reachable
+}
+
+// platformArgs gets the default values for the automatic platform args.
+func platformArgs() map[string]string {
+	p := platforms.DefaultSpec()
+	return map[string]string{
+		"BUILDPLATFORM":  platforms.Format(p),
+		"BUILDOS":        p.OS,
+		"BUILDARCH":      p.Architecture,
+		"BUILDVARIANT":   p.Variant,
+		"TARGETPLATFORM": platforms.Format(p),
+		"TARGETOS":       p.OS,
+		"TARGETARCH":     p.Architecture,
+		"TARGETVARIANT":  p.Variant,
+	}
+}
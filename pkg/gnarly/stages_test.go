@@ -0,0 +1,44 @@
+package gnarly
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReachableStages(t *testing.T) {
+	dockerfile := []byte(`
+FROM golang:1.18 AS tools
+FROM golang:1.18 AS build
+RUN --mount=type=bind,from=tools,target=/tools true
+FROM busybox AS unused
+FROM build AS test
+FROM alpine
+COPY --from=1 / /
+`)
+
+	stages, err := parseStages(dockerfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for target, expected := range map[string][]string{
+		"":        {"build", "stage-4", "tools"},
+		"test":    {"build", "test", "tools"},
+		"TOOLS":   {"tools"},
+		"unused":  {"unused"},
+		"missing": {},
+	} {
+		var actual []string
+		for name := range reachableStages(stages, target) {
+			actual = append(actual, name)
+		}
+		sort.Strings(actual)
+		if len(actual) == 0 && len(expected) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %v, got %v", target, expected, actual)
+		}
+	}
+}
@@ -19,9 +19,9 @@ func TestModOutput(t *testing.T) {
 			`)
 		extExpectedModfileOutput = Result{
 			Sources: []Source{
-				{Type: "docker-image", Ref: "docker.io/library/foo:1.0", Replace: "docker.io/library/bar:1.0"},
-				{Type: "docker-image", Ref: "docker.io/library/foo:latest", Replace: "docker.io/library/bar:latest"},
-				{Type: "docker-image", Ref: "docker.io/library/foo:unhandled"},
+				{Type: "docker-image", Ref: "docker.io/library/foo:1.0", Replace: "docker.io/library/bar:1.0", Targets: []string{"foo1", "foo3"}, Stages: []string{"foo1", "foo3"}, Uses: []string{"from"}},
+				{Type: "docker-image", Ref: "docker.io/library/foo:latest", Replace: "docker.io/library/bar:latest", Targets: []string{"foo2"}, Stages: []string{"foo2"}, Uses: []string{"from"}},
+				{Type: "docker-image", Ref: "docker.io/library/foo:unhandled", Targets: []string{"foo4"}, Stages: []string{"foo4"}, Uses: []string{"from"}},
 			},
 		}
 		extModConfig = []byte(`
@@ -58,6 +58,11 @@ func TestModOutput(t *testing.T) {
 			t.Run("modfile", testCmd(modFileOutput, withStdin, withDockerfile(bytes.NewReader(testDockerfile)), withFormat("modfile"), withModConfig(builtinModConfig)))
 			t.Run("build-flags", testCmd(flagsOutput, withStdin, withDockerfile(bytes.NewReader(testDockerfile)), withFormat("build-flags"), withModConfig(builtinModConfig)))
 		})
+		// The external mod config is a lookup table, which is detected without a mod-prog
+		t.Run("lookup table", func(t *testing.T) {
+			t.Run("modfile", testCmd(modFileOutput, withStdin, withDockerfile(bytes.NewReader(testDockerfile)), withFormat("modfile"), withModConfig(extModConfig)))
+			t.Run("build-flags", testCmd(flagsOutput, withStdin, withDockerfile(bytes.NewReader(testDockerfile)), withFormat("build-flags"), withModConfig(extModConfig)))
+		})
 	})
 	t.Run("file", func(t *testing.T) {
 		dir := t.TempDir()
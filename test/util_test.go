@@ -90,9 +90,13 @@ func marshalResult(t *testing.T, val interface{}) []byte {
 }
 
 type Source struct {
-	Type    string `json:"type"`
-	Ref     string `json:"ref"`
-	Replace string `json:"replace,omitempty"`
+	Type    string   `json:"type"`
+	Ref     string   `json:"ref"`
+	Replace string   `json:"replace,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Targets []string `json:"targets,omitempty"`
+	Stages  []string `json:"stages,omitempty"`
+	Uses    []string `json:"uses,omitempty"`
 }
 
 func (s Source) AsFlag() string {